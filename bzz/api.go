@@ -5,17 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/resolver"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 )
@@ -25,6 +29,14 @@ var (
 	slashes     = regexp.MustCompile("/+")
 )
 
+// dpa chunk store/retrieve instrumentation, surfaced through admin.metrics().
+var (
+	dpaRetrieveMeter = metrics.GetOrRegisterMeter("bzz/dpa/retrieve")
+	dpaRetrieveTimer = metrics.GetOrRegisterTimer("bzz/dpa/retrieve/time")
+	dpaStoreMeter    = metrics.GetOrRegisterMeter("bzz/dpa/store")
+	dpaStoreTimer    = metrics.GetOrRegisterTimer("bzz/dpa/store/time")
+)
+
 /*
 Api implements webserver/file system related content storage and retrieval
 on top of the dpa
@@ -91,8 +103,11 @@ func (self *Api) Stop() {
 // Get uses iterative manifest retrieval and prefix matching
 // to resolve path to content using dpa retrieve
 func (self *Api) Get(bzzpath string) (content []byte, mimeType string, status int, size int, err error) {
+	defer dpaRetrieveTimer.UpdateSince(time.Now())
+	dpaRetrieveMeter.Mark(1)
+
 	var reader SectionReader
-	reader, mimeType, status, err = self.getPath("/" + bzzpath)
+	reader, mimeType, status, _, err = self.getPath("/" + bzzpath)
 	if err != nil {
 		return
 	}
@@ -104,9 +119,83 @@ func (self *Api) Get(bzzpath string) (content []byte, mimeType string, status in
 	return
 }
 
+// HttpRange represents a single byte range as parsed from an HTTP `Range`
+// header. End is inclusive; a non-positive End means "until EOF".
+type HttpRange struct {
+	Start, End int64
+}
+
+// GetRange is the streaming counterpart of Get: it resolves bzzpath via the
+// same manifest walk, but instead of reading the whole entry into memory it
+// returns the underlying chunk-backed SectionReader as an io.ReadSeeker,
+// together with an ETag derived from the entry's content hash. Callers
+// (the HTTP proxy) translate this into `Range`/`If-None-Match` semantics:
+// a matching ifNoneMatch short-circuits to 304 once the manifest walk has
+// found the entry, without reading the entry's content, and a non-empty ranges seeks the reader to the first requested
+// range and limits it to that span so only the requested bytes are read.
+func (self *Api) GetRange(bzzpath string, ranges []HttpRange, ifNoneMatch string) (reader io.ReadSeeker, mimeType, etag string, status int, err error) {
+	var (
+		sr  SectionReader
+		key Key
+	)
+	sr, mimeType, status, key, err = self.getPath("/" + bzzpath)
+	if err != nil {
+		return nil, "", "", status, err
+	}
+	etag = fmt.Sprintf(`"%064x"`, []byte(key))
+	if ifNoneMatch != "" && ifNoneMatch == etag {
+		return nil, mimeType, etag, http.StatusNotModified, nil
+	}
+	if len(ranges) == 0 {
+		return sr, mimeType, etag, status, nil
+	}
+
+	// Only the first range is honored; multipart/byteranges for overlapping
+	// or out-of-order ranges is left to a future HTTP proxy change.
+	size := sr.Size()
+	rng := ranges[0]
+	end := rng.End
+	if end <= 0 || end >= size {
+		end = size - 1
+	}
+	if rng.Start < 0 || rng.Start > end {
+		return nil, mimeType, etag, http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("invalid range: %d-%d of %d", rng.Start, rng.End, size)
+	}
+	if _, err = sr.Seek(rng.Start, 0); err != nil {
+		return nil, mimeType, etag, http.StatusInternalServerError, err
+	}
+	return &rangeReader{sr, end + 1}, mimeType, etag, http.StatusPartialContent, nil
+}
+
+// rangeReader wraps a ReadSeeker already positioned at a range's start and
+// stops Read at the exclusive absolute offset end, so a caller that reads
+// through to EOF only ever sees the requested span rather than the rest of
+// the underlying entry.
+type rangeReader struct {
+	io.ReadSeeker
+	end int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	pos, err := r.ReadSeeker.Seek(0, 1)
+	if err != nil {
+		return 0, err
+	}
+	if pos >= r.end {
+		return 0, io.EOF
+	}
+	if remain := r.end - pos; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	return r.ReadSeeker.Read(p)
+}
+
 // Put provides singleton manifest creation and optional name registration
 // on top of dpa store
 func (self *Api) Put(content, contentType string) (string, error) {
+	defer dpaStoreTimer.UpdateSince(time.Now())
+	dpaStoreMeter.Mark(1)
+
 	sr := io.NewSectionReader(strings.NewReader(content), 0, int64(len(content)))
 	wg := &sync.WaitGroup{}
 	key, err := self.dpa.Store(sr, wg)
@@ -123,10 +212,171 @@ func (self *Api) Put(content, contentType string) (string, error) {
 	return fmt.Sprintf("%064x", key), nil
 }
 
-// Download replicates the manifest path structure on the local filesystem
-// under localpath
-func (self *Api) Download(bzzpath, localpath string) (string, error) {
-	return "", nil
+// downloadEntry is one manifest leaf discovered while walking the tree,
+// with its path already resolved relative to the download root.
+type downloadEntry struct {
+	path        string
+	key         Key
+	contentType string
+}
+
+// downloadError pairs a manifest path with the error that occurred
+// retrieving or writing it.
+type downloadError struct {
+	path string
+	err  error
+}
+
+func (e downloadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.path, e.err)
+}
+
+// multiError aggregates the per-file errors from a failed Download call, so
+// that one 404 doesn't hide the fact that every other file came through.
+type multiError struct {
+	errs  []error
+	total int
+}
+
+func (e *multiError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d files failed to download: %s", len(e.errs), e.total, strings.Join(msgs, "; "))
+}
+
+// DownloadProgress reports incremental progress for Api.Download, so a
+// console command can show throughput while files are still in flight.
+type DownloadProgress struct {
+	Path  string // manifest path of the file that just finished, successfully or not
+	Done  int    // files completed so far, including this one
+	Total int    // total number of files being downloaded
+	Err   error  // non-nil if this particular file failed
+}
+
+// Download replicates the manifest path structure rooted at bzzpath on the
+// local filesystem under localpath: it resolves bzzpath via Resolve,
+// recursively walks the manifest tree (following nested entries whose
+// contentType is manifestType) into a flat list of leaves, and retrieves
+// them concurrently, bounded by maxParallelFiles, mirroring Upload's
+// fan-out. Each leaf's contentType is preserved in a ".mime" sidecar file
+// next to it. A single file's failure doesn't abort the rest of the
+// download; every error is collected and returned together as a
+// *multiError. progress, if given, is called once per file as it
+// completes.
+func (self *Api) Download(bzzpath, localpath string, progress ...func(DownloadProgress)) (string, error) {
+	var report func(DownloadProgress)
+	if len(progress) > 0 {
+		report = progress[0]
+	}
+
+	rootKey, err := self.Resolve(bzzpath)
+	if err != nil {
+		return "", err
+	}
+
+	var entries []downloadEntry
+	if err := self.walkManifest(rootKey, "", &entries); err != nil {
+		return "", err
+	}
+
+	localpath, err = filepath.Abs(localpath)
+	if err != nil {
+		return "", err
+	}
+
+	cnt := len(entries)
+	errs := make([]error, cnt)
+	done := make(chan bool, maxParallelFiles)
+	dcnt := 0
+	var (
+		progressMu sync.Mutex
+		completed  int
+	)
+
+	for i, entry := range entries {
+		if i >= dcnt+maxParallelFiles {
+			<-done
+			dcnt++
+		}
+		go func(i int, entry downloadEntry) {
+			errs[i] = self.downloadEntry(entry, localpath)
+			if report != nil {
+				progressMu.Lock()
+				completed++
+				report(DownloadProgress{Path: entry.path, Done: completed, Total: cnt, Err: errs[i]})
+				progressMu.Unlock()
+			}
+			done <- true
+		}(i, entry)
+	}
+	for dcnt < cnt {
+		<-done
+		dcnt++
+	}
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, downloadError{path: entries[i].path, err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return "", &multiError{errs: failed, total: cnt}
+	}
+	return fmt.Sprintf("%064x", []byte(rootKey)), nil
+}
+
+// walkManifest recursively expands the manifest tree rooted at key into a
+// flat list of leaf entries in entries, prefixing each entry's path with
+// prefix. Entries whose contentType is manifestType are nested manifests
+// and are expanded rather than collected themselves.
+func (self *Api) walkManifest(key Key, prefix string, entries *[]downloadEntry) error {
+	reader := self.dpa.Retrieve(key)
+	data := make([]byte, reader.Size())
+	if _, err := reader.Read(data); err != nil && err != io.EOF {
+		return err
+	}
+	var man manifest
+	if err := json.Unmarshal(data, &man); err != nil {
+		return fmt.Errorf("manifest at '%064x' is malformed: %v", []byte(key), err)
+	}
+	for _, e := range man.Entries {
+		path := prefix + e.Path
+		if !hashMatcher.MatchString(e.Hash) {
+			return fmt.Errorf("incorrect hash '%s' for path '%s'", e.Hash, path)
+		}
+		childKey := Key(common.Hex2Bytes(e.Hash))
+		contentType := e.ContentType
+		if contentType == "" || contentType == manifestType {
+			if err := self.walkManifest(childKey, path, entries); err != nil {
+				return err
+			}
+			continue
+		}
+		*entries = append(*entries, downloadEntry{path: path, key: childKey, contentType: contentType})
+	}
+	return nil
+}
+
+// downloadEntry retrieves one manifest leaf's content and writes it under
+// localpath/entry.path, creating parent directories as needed, together
+// with a ".mime" sidecar file carrying its contentType.
+func (self *Api) downloadEntry(entry downloadEntry, localpath string) error {
+	dest := filepath.Join(localpath, entry.path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	reader := self.dpa.Retrieve(entry.key)
+	content := make([]byte, reader.Size())
+	if _, err := reader.Read(content); err != nil && err != io.EOF {
+		return err
+	}
+	if err := ioutil.WriteFile(dest, content, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest+".mime", []byte(entry.contentType), 0644)
 }
 
 const maxParallelFiles = 5
@@ -273,7 +523,7 @@ func (self *Api) Resolve(hostport string) (contentHash Key, errR errResolve) {
 	return
 }
 
-func (self *Api) getPath(uri string) (reader SectionReader, mimeType string, status int, err error) {
+func (self *Api) getPath(uri string) (reader SectionReader, mimeType string, status int, key Key, err error) {
 	parts := slashes.Split(uri, 3)
 	hostPort := parts[1]
 	var path string
@@ -283,7 +533,6 @@ func (self *Api) getPath(uri string) (reader SectionReader, mimeType string, sta
 	dpaLogger.Debugf("Swarm: host: '%s', path '%s' requested.", hostPort, path)
 
 	//resolving host and port
-	var key Key
 	key, err = self.Resolve(hostPort)
 	if err != nil {
 		return
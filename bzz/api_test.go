@@ -2,7 +2,9 @@ package bzz
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
@@ -67,6 +69,85 @@ func testGet(t *testing.T, api *Api, bzzhash string, expContent []byte, expMimeT
 	}
 }
 
+func TestApiGetRange(t *testing.T) {
+	api, err := testApi()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	content := "hello world, this is a range request test"
+	bzzhash, err := api.Put(content, "text/plain")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	for _, tt := range []struct {
+		rng      HttpRange
+		expected string
+	}{
+		{HttpRange{Start: 0, End: 4}, content[0:5]},
+		{HttpRange{Start: 6, End: 10}, content[6:11]},
+	} {
+		reader, mimeType, _, status, err := api.GetRange(bzzhash, []HttpRange{tt.rng}, "")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if status != http.StatusPartialContent {
+			t.Errorf("incorrect status. expected %d, got %d", http.StatusPartialContent, status)
+		}
+		if mimeType != "text/plain" {
+			t.Errorf("incorrect mimeType. expected 'text/plain', got '%s'", mimeType)
+		}
+		buf := make([]byte, tt.rng.End-tt.rng.Start+1)
+		if _, err := reader.Read(buf); err != nil {
+			t.Errorf("unexpected error reading range: %v", err)
+			continue
+		}
+		if string(buf) != tt.expected {
+			t.Errorf("incorrect range content. expected '%s', got '%s'", tt.expected, string(buf))
+		}
+		if n, err := reader.Read(buf); err != io.EOF {
+			t.Errorf("expected EOF reading past the requested range, got n=%d err=%v", n, err)
+		}
+	}
+}
+
+func TestApiGetConditional(t *testing.T) {
+	api, err := testApi()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	bzzhash, err := api.Put("hello", "text/plain")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	_, _, etag, status, err := api.GetRange(bzzhash, nil, "")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if status != 0 {
+		t.Errorf("incorrect status for plain GetRange. expected 0, got %d", status)
+	}
+	if etag == "" {
+		t.Errorf("expected a non-empty ETag")
+	}
+
+	_, _, _, status, err = api.GetRange(bzzhash, nil, etag)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if status != http.StatusNotModified {
+		t.Errorf("incorrect status for matching If-None-Match. expected %d, got %d", http.StatusNotModified, status)
+	}
+}
+
 func TestApiDirUpload(t *testing.T) {
 	api, err := testApi()
 	if err != nil {
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/bzz"
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/resolver"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/natspec"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/ethereum/go-ethereum/xeth"
@@ -28,6 +39,8 @@ func (js *jsre) adminBindings() {
 	eth := ethO.Object()
 	eth.Set("pendingTransactions", js.pendingTransactions)
 	eth.Set("resend", js.resend)
+	eth.Set("sign", js.sign)
+	js.wrapSendTransaction(eth)
 
 	js.re.Set("admin", struct{}{})
 	t, _ := js.re.Get("admin")
@@ -35,6 +48,8 @@ func (js *jsre) adminBindings() {
 	admin.Set("addPeer", js.addPeer)
 	admin.Set("startRPC", js.startRPC)
 	admin.Set("stopRPC", js.stopRPC)
+	admin.Set("startIPC", js.startIPC)
+	admin.Set("stopIPC", js.stopIPC)
 	admin.Set("nodeInfo", js.nodeInfo)
 	admin.Set("peers", js.peers)
 	admin.Set("newAccount", js.newAccount)
@@ -43,6 +58,9 @@ func (js *jsre) adminBindings() {
 	admin.Set("export", js.exportChain)
 	admin.Set("verbosity", js.verbosity)
 	admin.Set("progress", js.downloadProgress)
+	admin.Set("ecRecover", js.ecRecover)
+	admin.Set("sleep", js.sleep)
+	admin.Set("sleepBlocks", js.sleepBlocks)
 
 	admin.Set("miner", struct{}{})
 	t, _ = admin.Get("miner")
@@ -60,7 +78,23 @@ func (js *jsre) adminBindings() {
 	debug.Set("dumpBlock", js.dumpBlock)
 	debug.Set("getBlockRlp", js.getBlockRlp)
 	debug.Set("setHead", js.setHead)
-	debug.Set("processBlock", js.debugBlock)
+	debug.Set("processBlock", js.processBlock)
+
+	admin.Set("contractInfo", struct{}{})
+	t, _ = admin.Get("contractInfo")
+	contractInfo := t.Object()
+	contractInfo.Set("start", js.natspecStart)
+	contractInfo.Set("stop", js.natspecStop)
+	contractInfo.Set("newRegistry", js.natspecNewRegistry)
+	contractInfo.Set("register", js.natspecRegister)
+	contractInfo.Set("get", js.natspecGet)
+	contractInfo.Set("addURL", js.natspecAddURL)
+	contractInfo.Set("setABI", js.natspecSetABI)
+
+	admin.Set("metrics", js.metrics)
+	t, _ = admin.Get("metrics")
+	metricsObj := t.Object()
+	metricsObj.Set("reset", js.metricsReset)
 }
 
 func (js *jsre) getBlock(call otto.FunctionCall) (*types.Block, error) {
@@ -145,27 +179,117 @@ func (js *jsre) resend(call otto.FunctionCall) otto.Value {
 	return otto.FalseValue()
 }
 
-func (js *jsre) debugBlock(call otto.FunctionCall) otto.Value {
-	block, err := js.getBlock(call)
+// signHash returns the hash eth.sign and admin.ecRecover actually sign/
+// recover over: keccak256("\x19Ethereum Signed Message:\n"+len(data)+data).
+// Prefixing like this means a signature produced this way can never be
+// replayed as a valid signature over a raw transaction, which is purpose-
+// built to look completely different.
+func signHash(data []byte) []byte {
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), data)
+	return crypto.Keccak256([]byte(msg))
+}
+
+// sign signs data (a hex string) with the unlocked account at address,
+// returning a 65-byte secp256k1 signature (r||s||v) as a hex string. It
+// goes through AccountManager, so a locked account (one whose TimedUnlock
+// has expired or was never called) is refused rather than silently
+// returning a bad signature.
+func (js *jsre) sign(call otto.FunctionCall) otto.Value {
+	addr, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	data, err := call.Argument(1).ToString()
 	if err != nil {
 		fmt.Println(err)
 		return otto.UndefinedValue()
 	}
+	sig, err := js.ethereum.AccountManager().Sign(common.HexToAddress(addr), signHash(common.FromHex(data)))
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	return js.re.ToVal(common.ToHex(sig))
+}
 
-	if block == nil {
-		fmt.Println("block not found")
+// ecRecover recovers the address that produced sig (as returned by
+// eth.sign) over data, or undefined if sig doesn't recover to a valid
+// public key.
+func (js *jsre) ecRecover(call otto.FunctionCall) otto.Value {
+	data, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	sig, err := call.Argument(1).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	pubkey, err := crypto.SigToPub(signHash(common.FromHex(data)), common.FromHex(sig))
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	return js.re.ToVal(crypto.PubkeyToAddress(*pubkey).Hex())
+}
+
+// blockProcessResult is one entry of the JSON array admin.debug.processBlock
+// returns: the outcome of retrying a single historical block.
+type blockProcessResult struct {
+	Number   uint64         `json:"number"`
+	GasUsed  string         `json:"gasUsed"`
+	Receipts types.Receipts `json:"receipts,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// processBlock reprocesses every block in [fromBlockNum, toBlockNum] with
+// vm.Debug enabled, retrying each one through BlockProcessor().RetryProcess
+// and collecting its gas usage, receipts and any error into a JSON array.
+// This is what lets the console be driven as a regression-bisection harness
+// over a historical range, rather than one block at a time.
+func (js *jsre) processBlock(call otto.FunctionCall) otto.Value {
+	from, err := call.Argument(0).ToInteger()
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	to, err := call.Argument(1).ToInteger()
+	if err != nil {
+		fmt.Println(err)
 		return otto.UndefinedValue()
 	}
 
 	old := vm.Debug
 	vm.Debug = true
-	_, err = js.ethereum.BlockProcessor().RetryProcess(block)
-	if err != nil {
-		glog.Infoln(err)
+	defer func() { vm.Debug = old }()
+
+	var results []*blockProcessResult
+	for num := from; num <= to; num++ {
+		block := js.ethereum.ChainManager().GetBlockByNumber(uint64(num))
+		if block == nil {
+			results = append(results, &blockProcessResult{Number: uint64(num), Error: "block not found"})
+			continue
+		}
+
+		res := &blockProcessResult{Number: block.NumberU64(), GasUsed: block.GasUsed().String()}
+		receipts, err := js.ethereum.BlockProcessor().RetryProcess(block)
+		if err != nil {
+			glog.Infoln(err)
+			res.Error = err.Error()
+		} else {
+			res.Receipts = receipts
+		}
+		results = append(results, res)
 	}
-	vm.Debug = old
 
-	return otto.UndefinedValue()
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	return js.re.ToVal(string(encoded))
 }
 
 func (js *jsre) setHead(call otto.FunctionCall) otto.Value {
@@ -190,6 +314,59 @@ func (js *jsre) downloadProgress(call otto.FunctionCall) otto.Value {
 	return js.re.ToVal(fmt.Sprintf("%d/%d", current, max))
 }
 
+// sleep blocks the console for seconds, doing nothing else. It's a timer,
+// not a yield, so nothing else on the otto VM thread runs until it returns.
+func (js *jsre) sleep(call otto.FunctionCall) otto.Value {
+	seconds, err := call.Argument(0).ToInteger()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	time.Sleep(time.Duration(seconds) * time.Second)
+	return otto.TrueValue()
+}
+
+// sleepBlocks blocks until n further blocks have been imported, observed via
+// a ChainHeadEvent subscription on the node's event mux, or until timeoutSec
+// seconds have elapsed, whichever comes first. A timeoutSec of 0 (the
+// default, when omitted) means wait forever.
+func (js *jsre) sleepBlocks(call otto.FunctionCall) otto.Value {
+	n, err := call.Argument(0).ToInteger()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+
+	var timeout time.Duration
+	if len(call.ArgumentList) > 1 {
+		seconds, err := call.Argument(1).ToInteger()
+		if err != nil {
+			fmt.Println(err)
+			return otto.FalseValue()
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	sub := js.ethereum.EventMux().Subscribe(core.ChainHeadEvent{})
+	defer sub.Unsubscribe()
+
+	for seen := int64(0); seen < n; {
+		select {
+		case <-sub.Chan():
+			seen++
+		case <-deadline:
+			fmt.Printf("sleepBlocks: timed out after %d/%d blocks\n", seen, n)
+			return otto.FalseValue()
+		}
+	}
+	return otto.TrueValue()
+}
+
 func (js *jsre) getBlockRlp(call otto.FunctionCall) otto.Value {
 	block, err := js.getBlock(call)
 	if err != nil {
@@ -314,6 +491,44 @@ func (js *jsre) stopRPC(call otto.FunctionCall) otto.Value {
 	return otto.FalseValue()
 }
 
+// ipcPath returns the default IPC endpoint path, $datadir/geth.ipc, used
+// when admin.startIPC is called with no argument.
+func (js *jsre) ipcPath() string {
+	return filepath.Join(js.datadir, "geth.ipc")
+}
+
+// startIPC opens the IPC endpoint at path (default $datadir/geth.ipc),
+// dispatching JSON-RPC requests through the rpc/api registry, which no other
+// transport reads. Nothing calls api.Register, so the registry is empty and
+// every request this endpoint receives fails with "the method ... does not
+// exist/is not available" - none of the console's existing admin.*/eth.*
+// bindings are reachable here.
+func (js *jsre) startIPC(call otto.FunctionCall) otto.Value {
+	path := js.ipcPath()
+	if len(call.ArgumentList) > 0 {
+		p, err := call.Argument(0).ToString()
+		if err != nil {
+			fmt.Println(err)
+			return otto.FalseValue()
+		}
+		path = p
+	}
+
+	if err := rpc.StartIPC(path); err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	return otto.TrueValue()
+}
+
+// stopIPC closes the IPC endpoint opened by startIPC, if any.
+func (js *jsre) stopIPC(call otto.FunctionCall) otto.Value {
+	if rpc.StopIPC() == nil {
+		return otto.TrueValue()
+	}
+	return otto.FalseValue()
+}
+
 func (js *jsre) addPeer(call otto.FunctionCall) otto.Value {
 	nodeURL, err := call.Argument(0).ToString()
 	if err != nil {
@@ -493,6 +708,284 @@ func (js *jsre) dumpBlock(call otto.FunctionCall) otto.Value {
 
 }
 
+// urlHintsPath is where contractInfo.addURL persists its hash->URL seed
+// mappings, so they survive a restart of the console.
+func (js *jsre) urlHintsPath() string {
+	return filepath.Join(js.datadir, "natspec_urls.json")
+}
+
+func (js *jsre) urlHints() map[string]string {
+	hints := make(map[string]string)
+	data, err := ioutil.ReadFile(js.urlHintsPath())
+	if err != nil {
+		return hints
+	}
+	json.Unmarshal(data, &hints)
+	return hints
+}
+
+// natspecStart turns on NatSpec confirmation: eth.sendTransaction will hold
+// the transaction and show its NatSpec notice before actually sending it.
+func (js *jsre) natspecStart(call otto.FunctionCall) otto.Value {
+	js.natspecEnabled = true
+	return otto.UndefinedValue()
+}
+
+// natspecStop turns NatSpec confirmation back off.
+func (js *jsre) natspecStop(call otto.FunctionCall) otto.Value {
+	js.natspecEnabled = false
+	return otto.UndefinedValue()
+}
+
+// natspecNewRegistry points contractInfo.get at the HashReg contract deployed
+// at addr, the on-chain registry of code-hash -> content-hash mappings.
+func (js *jsre) natspecNewRegistry(call otto.FunctionCall) otto.Value {
+	addr, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	js.resolver = resolver.New(js.xeth)
+	js.resolver.SetHashReg(common.HexToAddress(addr))
+	return otto.TrueValue()
+}
+
+// natspecRegister registers contentHash as the NatSpec metadata document for
+// codeHash in the configured HashReg contract, sent from account.
+func (js *jsre) natspecRegister(call otto.FunctionCall) otto.Value {
+	if js.resolver == nil {
+		fmt.Println("no registry set, call admin.contractInfo.newRegistry first")
+		return otto.FalseValue()
+	}
+	account, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	codeHash, err := call.Argument(1).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	contentHash, err := call.Argument(2).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	txHash, err := js.resolver.RegisterContentHash(common.HexToAddress(account), common.HexToHash(codeHash), common.HexToHash(contentHash))
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	return js.re.ToVal(txHash)
+}
+
+// natspecGet fetches and returns the NatSpec metadata document registered
+// for codeHash. It is first looked up on swarm; if swarm has no copy, a URL
+// seeded earlier via addURL is tried over plain HTTP.
+func (js *jsre) natspecGet(call otto.FunctionCall) otto.Value {
+	if js.resolver == nil {
+		fmt.Println("no registry set, call admin.contractInfo.newRegistry first")
+		return otto.UndefinedValue()
+	}
+	codeHash, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	doc, err := js.fetchNatspecDoc(codeHash)
+	if err != nil {
+		fmt.Println(err)
+		return otto.UndefinedValue()
+	}
+	return js.re.ToVal(doc)
+}
+
+// fetchNatspecDoc resolves codeHash to its registered NatSpec metadata
+// document, first on swarm and, failing that, over plain HTTP at a URL
+// seeded earlier via addURL. It's the shared lookup behind both
+// contractInfo.get and the eth.sendTransaction pre-flight.
+func (js *jsre) fetchNatspecDoc(codeHash string) (string, error) {
+	contentHash, err := js.resolver.KeyToContentHash(common.HexToHash(codeHash))
+	if err != nil {
+		return "", err
+	}
+	if content, _, _, _, err := js.bzz.Get(common.Bytes2Hex(contentHash[:])); err == nil {
+		return string(content), nil
+	}
+	url, ok := js.urlHints()[contentHash.Hex()]
+	if !ok {
+		return "", fmt.Errorf("document not found on swarm and no URL seeded for it")
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// contractMeta is what contractInfo.setABI records for an address: enough
+// for the eth.sendTransaction pre-flight to match the called method and
+// fetch its notice document.
+type contractMeta struct {
+	ABI      string
+	CodeHash string
+}
+
+// natspecSetABI records addr's compiled ABI and NatSpec code hash, so calls
+// made to it through eth.sendTransaction can be matched against a method
+// and have their notice document fetched (see wrapSendTransaction). A
+// contract with nothing registered here is sent through untouched.
+func (js *jsre) natspecSetABI(call otto.FunctionCall) otto.Value {
+	addr, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	abi, err := call.Argument(1).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	codeHash, err := call.Argument(2).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	if js.contracts == nil {
+		js.contracts = make(map[string]contractMeta)
+	}
+	js.contracts[addr] = contractMeta{ABI: abi, CodeHash: codeHash}
+	return otto.TrueValue()
+}
+
+// natspecAddURL seeds an HTTP fallback for a content hash, used by
+// natspecGet when swarm has no copy of the document yet.
+func (js *jsre) natspecAddURL(call otto.FunctionCall) otto.Value {
+	hash, err := call.Argument(0).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	url, err := call.Argument(1).ToString()
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	hints := js.urlHints()
+	hints[hash] = url
+	data, err := json.Marshal(hints)
+	if err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	if err := ioutil.WriteFile(js.urlHintsPath(), data, 0644); err != nil {
+		fmt.Println(err)
+		return otto.FalseValue()
+	}
+	return otto.TrueValue()
+}
+
+// metrics returns the full go-metrics registry as a nested object: counters
+// as plain numbers, meters as {count, 1m, 5m, 15m, mean}, and timers as
+// {count, mean, p50, p75, p95, p99, p999} (plus min/max/stddev when raw is
+// true).
+func (js *jsre) metrics(call otto.FunctionCall) otto.Value {
+	raw := false
+	if len(call.ArgumentList) > 0 {
+		raw, _ = call.Argument(0).ToBoolean()
+	}
+	return js.re.ToVal(metrics.Snapshot(raw))
+}
+
+// metricsReset clears every counter/meter/timer back to zero.
+func (js *jsre) metricsReset(call otto.FunctionCall) otto.Value {
+	metrics.Reset()
+	return otto.UndefinedValue()
+}
+
+// natspecNotice resolves the human-readable NatSpec confirmation for tx,
+// using its compiled ABI and NatSpec metadata document. It is called from
+// eth.sendTransaction's pre-flight (wrapSendTransaction), before the
+// transaction is actually signed and sent, whenever natspecEnabled is set.
+func (js *jsre) natspecNotice(t *tx, abi, doc string) (string, error) {
+	spec, err := natspec.New(abi, doc, t.Data)
+	if err != nil {
+		return "", err
+	}
+	return spec.Notice()
+}
+
+// wrapSendTransaction replaces eth.sendTransaction with a version that, when
+// natspecEnabled is set and the call's target has a registered ABI (see
+// natspecSetABI), shows the user its NatSpec notice and asks for
+// confirmation before forwarding to the original implementation. With
+// natspecEnabled off, or for any call this pre-flight can't make sense of,
+// it's a transparent passthrough.
+func (js *jsre) wrapSendTransaction(eth *otto.Object) {
+	orig, err := eth.Get("sendTransaction")
+	if err != nil {
+		return
+	}
+	eth.Set("sendTransaction", func(call otto.FunctionCall) otto.Value {
+		if js.natspecEnabled && !js.confirmNatSpec(call) {
+			return otto.FalseValue()
+		}
+		args := make([]interface{}, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i] = arg
+		}
+		result, err := orig.Call(call.This, args...)
+		if err != nil {
+			fmt.Println(err)
+			return otto.UndefinedValue()
+		}
+		return result
+	})
+}
+
+// confirmNatSpec runs the NatSpec pre-flight for one eth.sendTransaction
+// call. It returns false only when a notice was actually shown and the user
+// declined it; any call it can't resolve to a known contract and method
+// (unregistered address, undocumented method, ...) is let through, the same
+// as if NatSpec were disabled.
+func (js *jsre) confirmNatSpec(call otto.FunctionCall) bool {
+	if len(call.ArgumentList) == 0 {
+		return true
+	}
+	exported, err := call.ArgumentList[0].Export()
+	if err != nil {
+		return true
+	}
+	fields, ok := exported.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	to, _ := fields["to"].(string)
+	data, _ := fields["data"].(string)
+	meta, ok := js.contracts[to]
+	if !ok || data == "" {
+		return true
+	}
+	doc, err := js.fetchNatspecDoc(meta.CodeHash)
+	if err != nil {
+		return true
+	}
+	notice, err := js.natspecNotice(&tx{Data: data}, meta.ABI, doc)
+	if err != nil || notice == "" {
+		return true
+	}
+	fmt.Printf("NatSpec notice: %s\nConfirm transaction? [y/N] ", notice)
+	var answer string
+	fmt.Scanln(&answer)
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+}
+
 // internal transaction type which will allow us to resend transactions  using `eth.resend`
 type tx struct {
 	tx *types.Transaction
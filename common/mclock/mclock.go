@@ -0,0 +1,113 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package mclock is a wrapper for a monotonic clock source that also allows
+// simulated time, so that code depending on absolute time (as opposed to
+// time.Duration intervals) can be driven deterministically in tests.
+package mclock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aristanetworks/goarista/atime"
+)
+
+// AbsTime represents absolute monotonic time in nanoseconds.
+type AbsTime time.Duration
+
+// Now returns the current absolute monotonic time.
+func Now() AbsTime {
+	return AbsTime(atime.NanoTime())
+}
+
+// Add returns t + d.
+func (t AbsTime) Add(d time.Duration) AbsTime {
+	return t + AbsTime(d)
+}
+
+// Clock interface makes it possible to replace the monotonic system clock
+// with a simulated clock, e.g. in tests that exercise time-dependent
+// behaviour (ticket expiration, topicRadius convergence, ...) without real
+// sleeps.
+type Clock interface {
+	Now() AbsTime
+	Sleep(time.Duration)
+	After(time.Duration) <-chan time.Time
+}
+
+// System implements Clock using the system clock.
+type System struct{}
+
+func (System) Now() AbsTime { return Now() }
+
+func (System) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (System) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Simulated implements Clock and allows the current time to be advanced
+// manually by calling Run. Timers registered through After fire as soon as
+// the simulated time passes their deadline.
+type Simulated struct {
+	mu     sync.Mutex
+	now    AbsTime
+	timers []*simTimer
+}
+
+type simTimer struct {
+	at AbsTime
+	c  chan time.Time
+}
+
+// Now returns the current simulated time.
+func (s *Simulated) Now() AbsTime {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Sleep blocks until the simulated time has advanced by d.
+func (s *Simulated) Sleep(d time.Duration) {
+	<-s.After(d)
+}
+
+// After returns a channel that receives the current time once the
+// simulated clock has advanced by d.
+func (s *Simulated) After(d time.Duration) <-chan time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &simTimer{at: s.now + AbsTime(d), c: make(chan time.Time, 1)}
+	s.timers = append(s.timers, t)
+	return t.c
+}
+
+// Run advances the simulated clock by d, firing any timers whose deadline
+// has been reached.
+func (s *Simulated) Run(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now += AbsTime(d)
+
+	remaining := s.timers[:0]
+	for _, t := range s.timers {
+		if t.at <= s.now {
+			t.c <- time.Unix(0, int64(s.now))
+		} else {
+			remaining = append(remaining, t)
+		}
+	}
+	s.timers = remaining
+}
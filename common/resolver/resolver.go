@@ -0,0 +1,81 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package resolver looks up and registers content hashes through a HashReg
+// ("global registrar") contract: a simple on-chain bytes32->bytes32 map from
+// a domain or code hash to the content hash of whatever it resolves to
+// (e.g. a swarm manifest, or a NatSpec metadata document). It is used both
+// by the bzz host-name resolver and by the admin console's NatSpec
+// contractInfo bindings.
+package resolver
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/xeth"
+)
+
+// contentSig and registerSig are the 4-byte selectors for HashReg's
+// content(bytes32) getter and register(bytes32,bytes32) setter.
+var (
+	contentSig  = crypto.Keccak256([]byte("content(bytes32)"))[:4]
+	registerSig = crypto.Keccak256([]byte("register(bytes32,bytes32)"))[:4]
+)
+
+// Resolver resolves and registers content hashes by calling into a HashReg
+// contract.
+type Resolver struct {
+	xeth     *xeth.XEth
+	registry common.Address
+}
+
+// New returns a Resolver that queries through xeth. SetHashReg must be
+// called with the registry's address before either method can succeed.
+func New(xeth *xeth.XEth) *Resolver {
+	return &Resolver{xeth: xeth}
+}
+
+// SetHashReg points the resolver at the HashReg contract deployed at addr.
+func (self *Resolver) SetHashReg(addr common.Address) {
+	self.registry = addr
+}
+
+// KeyToContentHash looks up the content hash registered for key (a domain
+// or code hash).
+func (self *Resolver) KeyToContentHash(key common.Hash) (content common.Hash, err error) {
+	if (self.registry == common.Address{}) {
+		return common.Hash{}, fmt.Errorf("no HashReg address set, call newRegistry first")
+	}
+	calldata := append(append([]byte{}, contentSig...), key[:]...)
+	ret, err := self.xeth.Call(self.registry.Hex(), fmt.Sprintf("0x%x", calldata))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.HexToHash(ret), nil
+}
+
+// RegisterContentHash submits a transaction from sender registering hash as
+// the content hash for key (a domain or code hash). It returns the hash of
+// the registering transaction.
+func (self *Resolver) RegisterContentHash(sender common.Address, key, hash common.Hash) (txHash string, err error) {
+	if (self.registry == common.Address{}) {
+		return "", fmt.Errorf("no HashReg address set, call newRegistry first")
+	}
+	calldata := append(append([]byte{}, registerSig...), append(key[:], hash[:]...)...)
+	return self.xeth.Transact(sender.Hex(), self.registry.Hex(), "", "0x0", "", "", fmt.Sprintf("0x%x", calldata))
+}
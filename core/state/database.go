@@ -0,0 +1,118 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/hashicorp/golang-lru"
+)
+
+// Number of past tries and code blobs to keep around. Account tries are
+// pretty large (several KB of decoded nodes for a busy contract), so these
+// are sized conservatively; bumping them costs memory, not correctness.
+const (
+	trieCacheLimit = 64
+	codeCacheLimit = 256
+)
+
+// Database wraps access to tries and contract code. A single Database is
+// meant to be shared by every StateObject opened against the same underlying
+// store, so that reopening an account trie root, an account's storage trie
+// at the same root, or a code hash already seen reuses the already-decoded
+// trie/code instead of hitting the disk again. Storage tries are cached per
+// account, so two accounts with the same storage root do not share one.
+type Database interface {
+	// OpenTrie opens the account trie rooted at root.
+	OpenTrie(root common.Hash) (*trie.SecureTrie, error)
+	// OpenStorageTrie opens the storage trie of the account with the given
+	// address hash, rooted at root.
+	OpenStorageTrie(addrHash, root common.Hash) (*trie.SecureTrie, error)
+	// ContractCode returns the contract code associated with codeHash.
+	ContractCode(codeHash common.Hash) ([]byte, error)
+	// Db returns the underlying key-value store.
+	Db() ethdb.Database
+}
+
+// NewDatabase creates a state.Database backed by db, with LRU caches for
+// recently opened account tries and recently fetched contract code.
+func NewDatabase(db ethdb.Database) Database {
+	trieCache, _ := lru.New(trieCacheLimit)
+	codeCache, _ := lru.New(codeCacheLimit)
+	return &cachingDB{
+		db:        db,
+		trieCache: trieCache,
+		codeCache: codeCache,
+	}
+}
+
+type cachingDB struct {
+	db        ethdb.Database
+	trieCache *lru.Cache
+	codeCache *lru.Cache
+}
+
+// storageTrieCacheKey disambiguates storage tries by account, since two
+// accounts can legitimately share a storage root (e.g. both empty).
+type storageTrieCacheKey struct {
+	addrHash, root common.Hash
+}
+
+func (db *cachingDB) Db() ethdb.Database {
+	return db.db
+}
+
+func (db *cachingDB) OpenTrie(root common.Hash) (*trie.SecureTrie, error) {
+	if t, ok := db.trieCache.Get(root); ok {
+		return t.(*trie.SecureTrie), nil
+	}
+	t, err := trie.NewSecure(root, db.db)
+	if err != nil {
+		return nil, err
+	}
+	db.trieCache.Add(root, t)
+	return t, nil
+}
+
+// OpenStorageTrie opens an account's storage trie. Storage tries are keyed
+// and cached the same way as the account trie; addrHash only disambiguates
+// the (rare) case of two accounts sharing an (empty) storage root.
+func (db *cachingDB) OpenStorageTrie(addrHash, root common.Hash) (*trie.SecureTrie, error) {
+	key := storageTrieCacheKey{addrHash, root}
+	if t, ok := db.trieCache.Get(key); ok {
+		return t.(*trie.SecureTrie), nil
+	}
+	t, err := trie.NewSecure(root, db.db)
+	if err != nil {
+		return nil, err
+	}
+	db.trieCache.Add(key, t)
+	return t, nil
+}
+
+func (db *cachingDB) ContractCode(codeHash common.Hash) ([]byte, error) {
+	if code, ok := db.codeCache.Get(codeHash); ok {
+		return code.([]byte), nil
+	}
+	code, err := db.db.Get(codeHash[:])
+	if err != nil {
+		return nil, err
+	}
+	db.codeCache.Add(codeHash, code)
+	return code, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// journalEntry is a modification to the state that can be reverted on
+// demand, restoring the StateObject field it touched to its pre-image.
+type journalEntry interface {
+	undo()
+}
+
+// journal is an ordered list of state modifications, used to implement
+// cheap nested rollback of StateObject mutations. Instead of deep-copying
+// every touched object, callers take a Snapshot (the current journal
+// length) before a risky operation (e.g. a CALL/CREATE frame) and
+// RevertToSnapshot if it fails, which replays the undo of every entry
+// appended since.
+type journal struct {
+	entries []journalEntry
+}
+
+func newJournal() *journal {
+	return new(journal)
+}
+
+func (j *journal) append(entry journalEntry) {
+	j.entries = append(j.entries, entry)
+}
+
+// snapshot returns an identifier for the current journal length.
+func (j *journal) snapshot() int {
+	return len(j.entries)
+}
+
+// revert undoes every entry appended since id, in reverse order.
+func (j *journal) revert(id int) {
+	for i := len(j.entries) - 1; i >= id; i-- {
+		j.entries[i].undo()
+	}
+	j.entries = j.entries[:id]
+}
+
+type (
+	balanceChange struct {
+		object *StateObject
+		prev   *big.Int
+	}
+	nonceChange struct {
+		object *StateObject
+		prev   uint64
+	}
+	codeChange struct {
+		object   *StateObject
+		prevCode Code
+	}
+	storageChange struct {
+		object      *StateObject
+		key         string
+		prevalue    common.Hash
+		prevexisted bool
+	}
+	gasLimitChange struct {
+		object *StateObject
+		prev   *big.Int
+	}
+	gasChange struct {
+		object *StateObject
+		prev   *big.Int
+	}
+	suicideChange struct {
+		object      *StateObject
+		prevRemove  bool
+		prevBalance *big.Int
+	}
+	// createObjectChange is the undo for StateDB.createStateObject: it drops
+	// the object from stateObjects entirely, so a CREATE that gets reverted
+	// leaves no trace of the account having ever existed, rather than just
+	// restoring its pre-creation field values in place.
+	createObjectChange struct {
+		statedb *StateDB
+		addr    common.Address
+	}
+)
+
+func (ch balanceChange) undo() {
+	ch.object.balance = ch.prev
+	ch.object.dirty = true
+}
+
+func (ch nonceChange) undo() {
+	ch.object.nonce = ch.prev
+	ch.object.dirty = true
+}
+
+func (ch codeChange) undo() {
+	ch.object.code = ch.prevCode
+	ch.object.dirty = true
+}
+
+func (ch storageChange) undo() {
+	if ch.prevexisted {
+		ch.object.storage[ch.key] = ch.prevalue
+	} else {
+		delete(ch.object.storage, ch.key)
+	}
+	ch.object.dirty = true
+}
+
+func (ch gasLimitChange) undo() {
+	ch.object.gasPool = ch.prev
+	ch.object.dirty = true
+}
+
+func (ch gasChange) undo() {
+	ch.object.gasPool = ch.prev
+	ch.object.dirty = true
+}
+
+func (ch suicideChange) undo() {
+	ch.object.remove = ch.prevRemove
+	ch.object.deleted = false
+	ch.object.balance = ch.prevBalance
+}
+
+func (ch createObjectChange) undo() {
+	delete(ch.statedb.stateObjects, ch.addr)
+}
@@ -22,7 +22,6 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/access"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
@@ -57,9 +56,15 @@ func (self Storage) Copy() Storage {
 
 type StateObject struct {
 	// State database for storing state changes
-	ca   *access.ChainAccess
+	db   Database
 	trie *TrieAccess
 
+	// journal records mutations made to this object so that they can be
+	// undone by the enclosing StateDB's RevertToSnapshot. nil until the
+	// object is bound to one, in which case mutators are plain in-place
+	// writes as before.
+	journal *journal
+
 	// Address belonging to this account
 	address common.Address
 	// The balance of the account
@@ -68,7 +73,8 @@ type StateObject struct {
 	nonce uint64
 	// The code hash if code is present (i.e. a contract)
 	codeHash []byte
-	// The code for this account
+	// The code for this account, lazily pulled from db.ContractCode on first
+	// access and cached here for the lifetime of the object
 	code Code
 	// Temporarily initialisation code
 	initCode Code
@@ -88,16 +94,16 @@ type StateObject struct {
 	dirty   bool
 }
 
-func NewStateObject(address common.Address, ca *access.ChainAccess) *StateObject {
-	object := &StateObject{ca: ca, address: address, balance: new(big.Int), gasPool: new(big.Int), dirty: true}
-	trie, _ := trie.NewSecure(common.Hash{}, ca.Db())
-	object.trie = NewStateTrieAccess(ca, trie, address)
+func NewStateObject(address common.Address, db Database) *StateObject {
+	object := &StateObject{db: db, address: address, balance: new(big.Int), gasPool: new(big.Int), dirty: true}
+	trie, _ := db.OpenStorageTrie(crypto.Sha3Hash(address[:]), common.Hash{})
+	object.trie = NewStateTrieAccess(db, trie, address)
 	object.storage = make(Storage)
 	object.gasPool = new(big.Int)
 	return object
 }
 
-func NewStateObjectFromBytes(address common.Address, data []byte, ca *access.ChainAccess) *StateObject {
+func NewStateObjectFromBytes(address common.Address, data []byte, db Database) *StateObject {
 	var extobject struct {
 		Nonce    uint64
 		Balance  *big.Int
@@ -109,25 +115,27 @@ func NewStateObjectFromBytes(address common.Address, data []byte, ca *access.Cha
 		glog.Errorf("can't decode state object %x: %v", address, err)
 		return nil
 	}
-	trie, err := trie.NewSecure(extobject.Root, ca.Db())
+	trie, err := db.OpenStorageTrie(crypto.Sha3Hash(address[:]), extobject.Root)
 	if err != nil {
 		// TODO: bubble this up or panic
 		glog.Errorf("can't create account trie with root %x: %v", extobject.Root[:], err)
 		return nil
 	}
 
-	object := &StateObject{address: address, ca: ca}
+	object := &StateObject{address: address, db: db}
 	object.nonce = extobject.Nonce
 	object.balance = extobject.Balance
 	object.codeHash = extobject.CodeHash
-	object.trie = NewStateTrieAccess(ca, trie, address)
+	object.trie = NewStateTrieAccess(db, trie, address)
 	object.storage = make(map[string]common.Hash)
 	object.gasPool = new(big.Int)
-	object.code = RetrieveNodeData(ca, common.BytesToHash(extobject.CodeHash))
 	return object
 }
 
 func (self *StateObject) MarkForDeletion() {
+	if self.journal != nil {
+		self.journal.append(suicideChange{object: self, prevRemove: self.remove, prevBalance: new(big.Int).Set(self.balance)})
+	}
 	self.remove = true
 	self.dirty = true
 
@@ -136,6 +144,12 @@ func (self *StateObject) MarkForDeletion() {
 	}
 }
 
+// SetJournal binds self to j so that subsequent mutators push undo entries
+// onto it. Passing nil detaches the object again.
+func (self *StateObject) SetJournal(j *journal) {
+	self.journal = j
+}
+
 func (c *StateObject) getAddr(addr common.Hash) common.Hash {
 	var ret []byte
 	value, _ := c.trie.Get(addr[:])
@@ -170,7 +184,12 @@ func (self *StateObject) GetState(key common.Hash) common.Hash {
 }
 
 func (self *StateObject) SetState(k, value common.Hash) {
-	self.storage[k.Str()] = value
+	key := k.Str()
+	if self.journal != nil {
+		prev, existed := self.storage[key]
+		self.journal.append(storageChange{object: self, key: key, prevalue: prev, prevexisted: existed})
+	}
+	self.storage[key] = value
 	self.dirty = true
 }
 
@@ -203,6 +222,9 @@ func (c *StateObject) SubBalance(amount *big.Int) {
 }
 
 func (c *StateObject) SetBalance(amount *big.Int) {
+	if c.journal != nil {
+		c.journal.append(balanceChange{object: c, prev: new(big.Int).Set(c.balance)})
+	}
 	c.balance = amount
 	c.dirty = true
 }
@@ -219,6 +241,9 @@ func (c *StateObject) St() Storage {
 func (c *StateObject) ReturnGas(gas, price *big.Int) {}
 
 func (self *StateObject) SetGasLimit(gasLimit *big.Int) {
+	if self.journal != nil {
+		self.journal.append(gasLimitChange{object: self, prev: new(big.Int).Set(self.gasPool)})
+	}
 	self.gasPool = new(big.Int).Set(gasLimit)
 	self.dirty = true
 
@@ -231,6 +256,9 @@ func (self *StateObject) SubGas(gas, price *big.Int) error {
 	if self.gasPool.Cmp(gas) < 0 {
 		return GasLimitError(self.gasPool, gas)
 	}
+	if self.journal != nil {
+		self.journal.append(gasChange{object: self, prev: new(big.Int).Set(self.gasPool)})
+	}
 	self.gasPool.Sub(self.gasPool, gas)
 	self.dirty = true
 	return nil
@@ -242,7 +270,7 @@ func (self *StateObject) AddGas(gas, price *big.Int) {
 }
 
 func (self *StateObject) Copy() *StateObject {
-	stateObject := NewStateObject(self.Address(), self.ca)
+	stateObject := NewStateObject(self.Address(), self.db)
 	stateObject.balance.Set(self.balance)
 	stateObject.codeHash = common.CopyBytes(self.codeHash)
 	stateObject.nonce = self.nonce
@@ -279,16 +307,36 @@ func (self *StateObject) Root() []byte {
 	return self.trie.Trie().Root()
 }
 
+// Code returns the contract code belonging to this object, fetching it
+// through the state database's code cache on first access.
 func (self *StateObject) Code() []byte {
+	if self.code != nil {
+		return self.code
+	}
+	if len(self.codeHash) == 0 {
+		return nil
+	}
+	code, err := self.db.ContractCode(common.BytesToHash(self.codeHash))
+	if err != nil {
+		glog.Errorf("can't load code hash %x: %v", self.codeHash, err)
+		return nil
+	}
+	self.code = code
 	return self.code
 }
 
 func (self *StateObject) SetCode(code []byte) {
+	if self.journal != nil {
+		self.journal.append(codeChange{object: self, prevCode: self.code})
+	}
 	self.code = code
 	self.dirty = true
 }
 
 func (self *StateObject) SetNonce(nonce uint64) {
+	if self.journal != nil {
+		self.journal.append(nonceChange{object: self, prev: self.nonce})
+	}
 	self.nonce = nonce
 	self.dirty = true
 }
@@ -330,14 +378,13 @@ func (c *StateObject) RlpDecode(data []byte) {
 	decoder := common.NewValueFromBytes(data)
 	c.nonce = decoder.Get(0).Uint()
 	c.balance = decoder.Get(1).BigInt()
-	trie, _ := trie.NewSecure(common.BytesToHash(decoder.Get(2).Bytes()), c.ca.Db())
-	c.trie = NewStateTrieAccess(c.ca, trie, c.Address())
+	trie, _ := c.db.OpenStorageTrie(crypto.Sha3Hash(c.address[:]), common.BytesToHash(decoder.Get(2).Bytes()))
+	c.trie = NewStateTrieAccess(c.db, trie, c.Address())
 	c.storage = make(map[string]common.Hash)
 	c.gasPool = new(big.Int)
 
 	c.codeHash = decoder.Get(3).Bytes()
-
-	c.code = RetrieveNodeData(c.ca, common.BytesToHash(c.codeHash))
+	c.code = nil
 }
 
 // Storage change object. Used by the manifest for notifying changes to
@@ -0,0 +1,104 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// StateDB owns every StateObject opened against a single account trie and
+// binds them all to one journal, so Snapshot/RevertToSnapshot can undo
+// mutations spread across many accounts (a CALL/CREATE frame touching
+// several contracts) as a single operation instead of each StateObject
+// tracking its own history independently.
+type StateDB struct {
+	db   Database
+	trie *trie.SecureTrie
+
+	stateObjects map[common.Address]*StateObject
+	journal      *journal
+}
+
+// New opens the account trie rooted at root and returns a StateDB backed by
+// db, ready to take snapshots of whatever StateObjects get opened through it.
+func New(root common.Hash, db Database) *StateDB {
+	tr, _ := db.OpenTrie(root)
+	return &StateDB{
+		db:           db,
+		trie:         tr,
+		stateObjects: make(map[common.Address]*StateObject),
+		journal:      newJournal(),
+	}
+}
+
+// GetStateObject returns the state object at addr, loading it from the
+// account trie and caching it on first access. It returns nil if the
+// account doesn't exist.
+func (self *StateDB) GetStateObject(addr common.Address) *StateObject {
+	if obj, ok := self.stateObjects[addr]; ok {
+		return obj
+	}
+	data, err := self.trie.Get(addr[:])
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	obj := NewStateObjectFromBytes(addr, data, self.db)
+	if obj == nil {
+		return nil
+	}
+	obj.SetJournal(self.journal)
+	self.stateObjects[addr] = obj
+	return obj
+}
+
+// GetOrNewStateObject returns the state object at addr, creating an empty
+// one (journaled the same as any other) if it doesn't already exist.
+func (self *StateDB) GetOrNewStateObject(addr common.Address) *StateObject {
+	obj := self.GetStateObject(addr)
+	if obj == nil {
+		obj = self.createStateObject(addr)
+	}
+	return obj
+}
+
+// CreateAccount replaces whatever state object is cached for addr with a
+// freshly created, empty one.
+func (self *StateDB) CreateAccount(addr common.Address) *StateObject {
+	return self.createStateObject(addr)
+}
+
+func (self *StateDB) createStateObject(addr common.Address) *StateObject {
+	obj := NewStateObject(addr, self.db)
+	obj.SetJournal(self.journal)
+	self.journal.append(createObjectChange{statedb: self, addr: addr})
+	self.stateObjects[addr] = obj
+	return obj
+}
+
+// Snapshot returns an identifier for self's current state. Passing it to
+// RevertToSnapshot later undoes every mutation made to any state object
+// opened through self since this call.
+func (self *StateDB) Snapshot() int {
+	return self.journal.snapshot()
+}
+
+// RevertToSnapshot undoes every state object mutation made since the
+// Snapshot call that produced id.
+func (self *StateDB) RevertToSnapshot(id int) {
+	self.journal.revert(id)
+}
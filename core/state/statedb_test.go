@@ -0,0 +1,69 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+func TestStateDBSnapshotRevert(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+	state := New(common.Hash{}, db)
+
+	addr := common.HexToAddress("0x01")
+	obj := state.GetOrNewStateObject(addr)
+	obj.SetBalance(big.NewInt(10))
+	obj.SetNonce(1)
+
+	snap := state.Snapshot()
+
+	obj.SetBalance(big.NewInt(20))
+	obj.SetNonce(2)
+	if obj.Balance().Cmp(big.NewInt(20)) != 0 || obj.Nonce() != 2 {
+		t.Fatalf("mutation didn't take effect: balance=%v nonce=%d", obj.Balance(), obj.Nonce())
+	}
+
+	state.RevertToSnapshot(snap)
+
+	if obj.Balance().Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("balance not reverted: got %v, want 10", obj.Balance())
+	}
+	if obj.Nonce() != 1 {
+		t.Errorf("nonce not reverted: got %d, want 1", obj.Nonce())
+	}
+}
+
+func TestStateDBRevertRemovesCreatedObject(t *testing.T) {
+	db := NewDatabase(ethdb.NewMemDatabase())
+	state := New(common.Hash{}, db)
+
+	snap := state.Snapshot()
+
+	addr := common.HexToAddress("0x02")
+	obj := state.GetOrNewStateObject(addr)
+	obj.SetBalance(big.NewInt(5))
+
+	state.RevertToSnapshot(snap)
+
+	if _, ok := state.stateObjects[addr]; ok {
+		t.Errorf("state object created after snapshot wasn't removed on revert")
+	}
+}
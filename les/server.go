@@ -18,9 +18,11 @@
 package les
 
 import (
-"fmt"
+	"fmt"
 	"encoding/binary"
 	"math"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -30,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/les/flowcontrol"
 	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
@@ -109,85 +112,169 @@ func (table requestCostTable) encode() RequestCostList {
 	return list
 }
 
-type linReg struct {
-	sumX, sumY, sumXX, sumXY float64
-	cnt uint64
+// robustCostEstimator keeps a bounded ring buffer of the last rcWindowSize
+// (reqCnt, cost) samples observed for one message code and derives a
+// cost/request slope and a base cost from it using Theil-Sen regression
+// instead of ordinary least squares. A single anomalous sample (a cold
+// cache, or a client deliberately inflating reqCnt/cost) can permanently
+// skew an OLS fit; a median of pairwise slopes shrugs it off.
+type robustCostEstimator struct {
+	samples []costSample
+	head    int
+	cnt     uint64
 }
 
-const linRegMaxCnt = 100000
+type costSample struct {
+	reqCnt, cost float64
+}
+
+const (
+	rcWindowSize = 4096
+	rcMinSamples = 50 // below this, fall back to the plain mean-based estimate
+)
 
-func (l *linReg) add(x, y float64) {
-	if l.cnt >= linRegMaxCnt {
-		sub := float64(l.cnt+1-linRegMaxCnt)/linRegMaxCnt
-		l.sumX -= l.sumX*sub
-		l.sumY -= l.sumY*sub
-		l.sumXX -= l.sumXX*sub
-		l.sumXY -= l.sumXY*sub
-		l.cnt = linRegMaxCnt-1
+func newRobustCostEstimator() *robustCostEstimator {
+	return &robustCostEstimator{samples: make([]costSample, 0, rcWindowSize)}
+}
+
+func (r *robustCostEstimator) add(reqCnt, cost float64) {
+	s := costSample{reqCnt, cost}
+	if len(r.samples) < rcWindowSize {
+		r.samples = append(r.samples, s)
+	} else {
+		r.samples[r.head] = s
+		r.head = (r.head + 1) % rcWindowSize
 	}
-	l.cnt++
-	l.sumX += x
-	l.sumY += y
-	l.sumXX += x*x
-	l.sumXY += x*y
+	r.cnt++
 }
 
-func (l *linReg) calc() (b, m float64) {
-	if l.cnt == 0 {
+// calc returns the estimated base cost b and per-request cost m such that
+// cost ~= b + m*reqCnt.
+func (r *robustCostEstimator) calc() (b, m float64) {
+	n := len(r.samples)
+	if n == 0 {
 		return 0, 0
 	}
-	cnt := float64(l.cnt)
-	d := cnt*l.sumXX - l.sumX*l.sumX
+	if n < rcMinSamples {
+		return r.meanEstimate()
+	}
+	return r.theilSenEstimate()
+}
+
+// meanEstimate is the degenerate small-N fallback: an ordinary least
+// squares fit over every sample currently held.
+func (r *robustCostEstimator) meanEstimate() (b, m float64) {
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range r.samples {
+		sumX += s.reqCnt
+		sumY += s.cost
+		sumXX += s.reqCnt * s.reqCnt
+		sumXY += s.reqCnt * s.cost
+	}
+	n := float64(len(r.samples))
+	d := n*sumXX - sumX*sumX
 	if d < 0.001 {
-		return l.sumY/cnt, 0
+		return sumY / n, 0
 	}
-    m = (cnt*l.sumXY - l.sumX*l.sumY) / d
-    b = (l.sumY/cnt) - (m*l.sumX/cnt)
+	m = (n*sumXY - sumX*sumY) / d
+	b = (sumY / n) - (m * sumX / n)
 	return b, m
 }
 
-func (l *linReg) toBytes() []byte {
-	var arr [40]byte
-	binary.BigEndian.PutUint64(arr[0:8], math.Float64bits(l.sumX))
-	binary.BigEndian.PutUint64(arr[8:16], math.Float64bits(l.sumY))
-	binary.BigEndian.PutUint64(arr[16:24], math.Float64bits(l.sumXX))
-	binary.BigEndian.PutUint64(arr[24:32], math.Float64bits(l.sumXY))
-	binary.BigEndian.PutUint64(arr[32:40], l.cnt)
-	return arr[:]
+// theilSenMaxPairs bounds the number of pairwise slopes considered per
+// calc() so the estimate stays cheap even at the full window size.
+const theilSenMaxPairs = 2048
+
+// theilSenEstimate computes the slope as the median of pairwise slopes
+// (y_j-y_i)/(x_j-x_i) over a random subsample of pairs, and the intercept
+// as the median of y_i - slope*x_i.
+func (r *robustCostEstimator) theilSenEstimate() (b, m float64) {
+	n := len(r.samples)
+	pairs := n * (n - 1) / 2
+	if pairs > theilSenMaxPairs {
+		pairs = theilSenMaxPairs
+	}
+	slopes := make([]float64, 0, pairs)
+	for k := 0; k < pairs; k++ {
+		i := rand.Intn(n)
+		j := rand.Intn(n)
+		if i == j {
+			continue
+		}
+		dx := r.samples[j].reqCnt - r.samples[i].reqCnt
+		if dx == 0 {
+			continue
+		}
+		slopes = append(slopes, (r.samples[j].cost-r.samples[i].cost)/dx)
+	}
+	if len(slopes) == 0 {
+		return r.meanEstimate()
+	}
+	m = median(slopes)
+
+	intercepts := make([]float64, n)
+	for i, s := range r.samples {
+		intercepts[i] = s.cost - m*s.reqCnt
+	}
+	b = median(intercepts)
+	return b, m
+}
+
+func median(xs []float64) float64 {
+	sort.Float64s(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
 }
 
-func linRegFromBytes(data []byte) *linReg {
-	if len(data) != 40 {
+// toBytes persists the ring buffer as a flat list of Float64bits-encoded
+// (reqCnt, cost) pairs, replacing the old 40-byte linReg encoding.
+func (r *robustCostEstimator) toBytes() []byte {
+	buf := make([]byte, 8+16*len(r.samples))
+	binary.BigEndian.PutUint64(buf[0:8], r.cnt)
+	for i, s := range r.samples {
+		off := 8 + i*16
+		binary.BigEndian.PutUint64(buf[off:off+8], math.Float64bits(s.reqCnt))
+		binary.BigEndian.PutUint64(buf[off+8:off+16], math.Float64bits(s.cost))
+	}
+	return buf
+}
+
+func robustCostEstimatorFromBytes(data []byte) *robustCostEstimator {
+	if len(data) < 8 || (len(data)-8)%16 != 0 {
 		return nil
 	}
-	l := &linReg{}
-	l.sumX = math.Float64frombits(binary.BigEndian.Uint64(data[0:8]))
-	l.sumY = math.Float64frombits(binary.BigEndian.Uint64(data[8:16]))
-	l.sumXX = math.Float64frombits(binary.BigEndian.Uint64(data[16:24]))
-	l.sumXY = math.Float64frombits(binary.BigEndian.Uint64(data[24:32]))
-	l.cnt = binary.BigEndian.Uint64(data[32:40])
-	return l
+	r := newRobustCostEstimator()
+	r.cnt = binary.BigEndian.Uint64(data[0:8])
+	for off := 8; off < len(data); off += 16 {
+		reqCnt := math.Float64frombits(binary.BigEndian.Uint64(data[off : off+8]))
+		cost := math.Float64frombits(binary.BigEndian.Uint64(data[off+8 : off+16]))
+		r.samples = append(r.samples, costSample{reqCnt, cost})
+	}
+	return r
 }
 
 type requestCostStats struct {
-	lock     sync.RWMutex
-	db       ethdb.Database
-	stats	map[uint64]*linReg
+	lock  sync.RWMutex
+	db    ethdb.Database
+	stats map[uint64]*robustCostEstimator
 }
 
-type requestCostStatsRlp []struct{
+type requestCostStatsRlp []struct {
 	MsgCode uint64
-	Data []byte
+	Data    []byte
 }
 
 var rcStatsKey = []byte("_requestCostStats")
 
 func newCostStats(db ethdb.Database) *requestCostStats {
-	stats := make(map[uint64]*linReg)
+	stats := make(map[uint64]*robustCostEstimator)
 	for _, code := range reqList {
-		stats[code] = &linReg{cnt: 100}
+		stats[code] = newRobustCostEstimator()
 	}
-	
+
 	if db != nil {
 		data, err := db.Get(rcStatsKey)
 		var statsRlp requestCostStatsRlp
@@ -197,8 +284,8 @@ func newCostStats(db ethdb.Database) *requestCostStats {
 		if err == nil {
 			for _, r := range statsRlp {
 				if stats[r.MsgCode] != nil {
-					if l := linRegFromBytes(r.Data); l != nil {
-						stats[r.MsgCode] = l
+					if e := robustCostEstimatorFromBytes(r.Data); e != nil {
+						stats[r.MsgCode] = e
 					}
 				}
 			}
@@ -206,8 +293,8 @@ func newCostStats(db ethdb.Database) *requestCostStats {
 	}
 
 	return &requestCostStats{
-		db:       db,
-		stats:	stats,
+		db:    db,
+		stats: stats,
 	}
 }
 
@@ -231,10 +318,8 @@ func (s *requestCostStats) getCurrentList() RequestCostList {
 	defer s.lock.Unlock()
 
 	list := make(RequestCostList, len(reqList))
-fmt.Println("RequestCostList")
 	for idx, code := range reqList {
 		b, m := s.stats[code].calc()
-fmt.Println(code, s.stats[code].cnt, b/1000000, m/1000000)
 		if m < 0 {
 			b += m
 			m = 0
@@ -242,10 +327,10 @@ fmt.Println(code, s.stats[code].cnt, b/1000000, m/1000000)
 		if b < 0 {
 			b = 0
 		}
-		
+
 		list[idx].MsgCode = code
-		list[idx].BaseCost = uint64(b*2)
-		list[idx].ReqCost = uint64(m*2)
+		list[idx].BaseCost = uint64(b * 2)
+		list[idx].ReqCost = uint64(m * 2)
 	}
 	return list
 }
@@ -322,6 +407,86 @@ func storeChtRoot(db ethdb.Database, num uint64, root common.Hash) {
 	db.Put(append(chtPrefix, encNumber[:]...), root[:])
 }
 
+// GetHeaderProofsMsg/HeaderProofsMsg let a light client verify a historical
+// header's canonical hash and total difficulty against a CHT root it has
+// already pinned, instead of having to trust an announced header outright.
+const (
+	GetHeaderProofsMsg = 0x0f
+	HeaderProofsMsg    = 0x10
+)
+
+// ChtReq identifies a single (cht number, block number) pair that a client
+// wants a Merkle proof for.
+type ChtReq struct {
+	ChtNum, BlockNum uint64
+}
+
+// ChtResp is the server's answer to a ChtReq: the encoded light.ChtNode
+// stored under BlockNum in cht ChtNum, plus the trie proof nodes required
+// to verify it against the committed CHT root.
+type ChtResp struct {
+	Node  light.ChtNode
+	Proof []rlp.RawValue
+}
+
+// proofList accumulates the trie nodes visited while proving a single key,
+// implementing the ethdb.Putter interface trie.Prove writes through.
+type proofList []rlp.RawValue
+
+func (n *proofList) Put(key []byte, value []byte) error {
+	*n = append(*n, value)
+	return nil
+}
+
+// openCht opens the historical CHT trie rooted at the committed root for
+// chtNum. It works even when only the root hash was ever cached, since the
+// intermediate nodes are still present in the chain db from when the CHT
+// was built and get pulled on demand as the trie is walked.
+func openCht(db ethdb.Database, chtNum uint64) (*trie.Trie, error) {
+	root := getChtRoot(db, chtNum)
+	if root == (common.Hash{}) {
+		return nil, fmt.Errorf("unknown CHT #%d", chtNum)
+	}
+	return trie.New(root, db)
+}
+
+// headerProofTimer tracks how long a batch of CHT proof requests takes to
+// answer, surfaced through admin.metrics().
+var headerProofTimer = metrics.GetOrRegisterTimer("les/server/headerProofs")
+
+// getHeaderProofs answers a batch of CHT proof requests. Requests against
+// a CHT we have no root for are silently skipped rather than failing the
+// whole batch, mirroring how other LES batch requests degrade.
+func (pm *ProtocolManager) getHeaderProofs(reqs []ChtReq) []ChtResp {
+	defer headerProofTimer.UpdateSince(time.Now())
+
+	resps := make([]ChtResp, 0, len(reqs))
+	for _, req := range reqs {
+		t, err := openCht(pm.chainDb, req.ChtNum)
+		if err != nil {
+			continue
+		}
+		var encNumber [8]byte
+		binary.BigEndian.PutUint64(encNumber[:], req.BlockNum)
+
+		value, _ := t.Get(encNumber[:])
+		if value == nil {
+			continue
+		}
+		var node light.ChtNode
+		if err := rlp.DecodeBytes(value, &node); err != nil {
+			continue
+		}
+
+		var proof proofList
+		if err := t.Prove(encNumber[:], 0, &proof); err != nil {
+			continue
+		}
+		resps = append(resps, ChtResp{Node: node, Proof: proof})
+	}
+	return resps
+}
+
 func makeCht(db ethdb.Database) bool {
 	headHash := core.GetHeadBlockHash(db)
 	headNum := core.GetBlockNumber(db, headHash)
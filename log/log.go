@@ -0,0 +1,138 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package log provides structured, leveled logging with a key/value
+// context, replacing the one-off fmt.Println-based loggers scattered
+// through older packages (e.g. discover.logChn).
+//
+// This is currently used by p2p/discover and metrics; other packages
+// (cmd/geth, core/state, rpc, ...) still log through the older logger/glog
+// package. The two
+// aren't bridged, so a process using both ends up with two independently
+// configured log outputs until the rest of the tree is migrated.
+package log
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Lvl is a log priority level, ordered from most to least severe.
+type Lvl int
+
+const (
+	LvlCrit Lvl = iota
+	LvlError
+	LvlWarn
+	LvlInfo
+	LvlDebug
+	LvlTrace
+)
+
+func (l Lvl) String() string {
+	switch l {
+	case LvlTrace:
+		return "trce"
+	case LvlDebug:
+		return "dbug"
+	case LvlInfo:
+		return "info"
+	case LvlWarn:
+		return "warn"
+	case LvlError:
+		return "eror"
+	case LvlCrit:
+		return "crit"
+	default:
+		return "unkn"
+	}
+}
+
+// Logger writes leveled log messages together with a key/value context.
+type Logger interface {
+	Trace(msg string, ctx ...interface{})
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+	Crit(msg string, ctx ...interface{})
+}
+
+type logger struct {
+	ctx []interface{}
+}
+
+// New returns a Logger that prepends ctx (alternating key/value pairs) to
+// every message it logs, in addition to whatever context is passed at the
+// call site.
+func New(ctx ...interface{}) Logger {
+	return &logger{ctx: ctx}
+}
+
+// root is the logger backing the package-level Trace/Debug/... functions.
+var root = &logger{}
+
+// level is the minimum level that gets written out; anything less severe
+// (i.e. with a higher Lvl value) is dropped.
+var level = LvlInfo
+
+// SetLevel changes the minimum level the package will emit. It exists so
+// callers (tests, command-line flags) can turn on Trace/Debug output
+// without threading a Logger through every call site.
+func SetLevel(lvl Lvl) { level = lvl }
+
+func (l *logger) write(lvl Lvl, msg string, ctx []interface{}) {
+	if lvl > level {
+		return
+	}
+	line := fmt.Sprintf("%s[%s] %s", time.Now().Format("01-02|15:04:05.000"), lvl, msg)
+	for i := 0; i+1 < len(l.ctx); i += 2 {
+		line += fmt.Sprintf(" %v=%v", l.ctx[i], l.ctx[i+1])
+	}
+	for i := 0; i+1 < len(ctx); i += 2 {
+		line += fmt.Sprintf(" %v=%v", ctx[i], ctx[i+1])
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+func (l *logger) Trace(msg string, ctx ...interface{}) { l.write(LvlTrace, msg, ctx) }
+func (l *logger) Debug(msg string, ctx ...interface{}) { l.write(LvlDebug, msg, ctx) }
+func (l *logger) Info(msg string, ctx ...interface{})  { l.write(LvlInfo, msg, ctx) }
+func (l *logger) Warn(msg string, ctx ...interface{})  { l.write(LvlWarn, msg, ctx) }
+func (l *logger) Error(msg string, ctx ...interface{}) { l.write(LvlError, msg, ctx) }
+func (l *logger) Crit(msg string, ctx ...interface{}) {
+	l.write(LvlCrit, msg, ctx)
+	os.Exit(1)
+}
+
+// Trace logs a message at LvlTrace through the root logger.
+func Trace(msg string, ctx ...interface{}) { root.Trace(msg, ctx...) }
+
+// Debug logs a message at LvlDebug through the root logger.
+func Debug(msg string, ctx ...interface{}) { root.Debug(msg, ctx...) }
+
+// Info logs a message at LvlInfo through the root logger.
+func Info(msg string, ctx ...interface{}) { root.Info(msg, ctx...) }
+
+// Warn logs a message at LvlWarn through the root logger.
+func Warn(msg string, ctx ...interface{}) { root.Warn(msg, ctx...) }
+
+// Error logs a message at LvlError through the root logger.
+func Error(msg string, ctx ...interface{}) { root.Error(msg, ctx...) }
+
+// Crit logs a message at LvlCrit through the root logger, then exits.
+func Crit(msg string, ctx ...interface{}) { root.Crit(msg, ctx...) }
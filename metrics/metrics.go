@@ -0,0 +1,160 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics wraps github.com/rcrowley/go-metrics with the one
+// registry every subsystem (bzz, les, p2p/discover, ...) registers its
+// counters/meters/timers/histograms into, plus a couple of helpers for
+// surfacing it: Snapshot turns it into plain JSON-friendly data for
+// admin.metrics(), and LogForever periodically dumps it at INFO for
+// --metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Registry is the global registry every subsystem's counters/meters/timers
+// are registered into.
+var Registry = metrics.NewRegistry()
+
+// GetOrRegisterCounter returns the named counter from Registry, creating it
+// if this is the first call for name.
+func GetOrRegisterCounter(name string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(name, Registry)
+}
+
+// GetOrRegisterMeter returns the named meter from Registry, creating it if
+// this is the first call for name.
+func GetOrRegisterMeter(name string) metrics.Meter {
+	return metrics.GetOrRegisterMeter(name, Registry)
+}
+
+// GetOrRegisterTimer returns the named timer from Registry, creating it if
+// this is the first call for name.
+func GetOrRegisterTimer(name string) metrics.Timer {
+	return metrics.GetOrRegisterTimer(name, Registry)
+}
+
+// GetOrRegisterGauge returns the named gauge from Registry, creating it if
+// this is the first call for name. Gauges are for point-in-time values that
+// go up and down (queue depths, entry counts, ...), as opposed to counters
+// (which only accumulate).
+func GetOrRegisterGauge(name string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(name, Registry)
+}
+
+// Reset clears every metric back to zero, without removing them from
+// Registry (so existing *Counter/*Meter/*Timer handles held by instrumented
+// code stay valid).
+func Reset() {
+	Registry.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			m.Clear()
+		case metrics.Meter:
+			// Meters have no Clear(); re-registering replaces it with a
+			// fresh one under the same name.
+			metrics.GetOrRegisterMeter(name, Registry).Stop()
+			Registry.Unregister(name)
+			metrics.GetOrRegisterMeter(name, Registry)
+		case metrics.Timer:
+			m.Stop()
+			Registry.Unregister(name)
+			metrics.GetOrRegisterTimer(name, Registry)
+		case metrics.Histogram:
+			m.Clear()
+		case metrics.Gauge:
+			m.Update(0)
+		}
+	})
+}
+
+// Snapshot walks Registry and converts it into a tree of plain
+// maps/slices/numbers, suitable for admin.metrics()'s otto/JSON export. When
+// raw is true, timers also carry min/max/stddev; counters, gauges, meters
+// and histograms are summarised the same way either way.
+func Snapshot(raw bool) map[string]interface{} {
+	out := make(map[string]interface{})
+	Registry.Each(func(name string, i interface{}) {
+		out[name] = snapshotOne(i, raw)
+	})
+	return out
+}
+
+func snapshotOne(i interface{}, raw bool) interface{} {
+	switch m := i.(type) {
+	case metrics.Counter:
+		return m.Count()
+	case metrics.Gauge:
+		return m.Value()
+	case metrics.Meter:
+		s := m.Snapshot()
+		v := map[string]interface{}{
+			"count": s.Count(),
+			"1m":    s.Rate1(),
+			"5m":    s.Rate5(),
+			"15m":   s.Rate15(),
+			"mean":  s.RateMean(),
+		}
+		return v
+	case metrics.Timer:
+		s := m.Snapshot()
+		v := map[string]interface{}{
+			"count": s.Count(),
+			"mean":  s.Mean(),
+			"p50":   s.Percentile(0.50),
+			"p75":   s.Percentile(0.75),
+			"p95":   s.Percentile(0.95),
+			"p99":   s.Percentile(0.99),
+			"p999":  s.Percentile(0.999),
+		}
+		if raw {
+			v["min"] = s.Min()
+			v["max"] = s.Max()
+			v["stddev"] = s.StdDev()
+		}
+		return v
+	case metrics.Histogram:
+		s := m.Snapshot()
+		return map[string]interface{}{
+			"count": s.Count(),
+			"mean":  s.Mean(),
+			"p50":   s.Percentile(0.50),
+			"p99":   s.Percentile(0.99),
+		}
+	default:
+		return nil
+	}
+}
+
+// LogForever logs a Snapshot(false) at INFO every interval, until stopped by
+// closing done. It is meant to back the --metrics CLI flag's reporting
+// goroutine.
+func LogForever(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Info("Metrics snapshot", "metrics", Snapshot(false))
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package natspec resolves the human-readable NatSpec confirmation message
+// for a pending transaction, given the target contract's NatSpec metadata
+// document (its userdoc, fetched separately via swarm or a seeded URL), its
+// ABI and the transaction's call data.
+package natspec
+
+import (
+	"fmt"
+
+	"github.com/robertkrimen/otto"
+)
+
+// jsSource implements evaluateExpression(abi, doc, data): it decodes data
+// against abi to find the called method and its arguments, looks up that
+// method's notice template in doc's userdoc section, and substitutes each
+// "`argName`" placeholder with the corresponding decoded argument. It
+// returns the empty string if the method isn't documented.
+const jsSource = `
+function evaluateExpression(abi, doc, data) {
+	var userdoc = JSON.parse(doc);
+	var parsedAbi = JSON.parse(abi);
+	var method = parsedAbi.filter(function(entry) {
+		if (entry.type !== "function") {
+			return false;
+		}
+		var signature = entry.name + "(" + entry.inputs.map(function(i) { return i.type; }).join(",") + ")";
+		return data.indexOf(web3.sha3(signature).substring(0, 10)) === 0;
+	})[0];
+	if (!method || !userdoc.methods) {
+		return "";
+	}
+	var entry = userdoc.methods[method.name + "(" + method.inputs.map(function(i) { return i.type; }).join(",") + ")"];
+	if (!entry || !entry.notice) {
+		return "";
+	}
+	var params = web3.eth.abi.decodeParameters(method.inputs, "0x" + data.substring(10));
+	return entry.notice.replace(/\x60([a-zA-Z0-9_]+)\x60/g, function(_, name) {
+		return params[name];
+	});
+}
+`
+
+// NatSpec evaluates the confirmation message for one pending transaction. It
+// is not safe for concurrent use.
+type NatSpec struct {
+	vm   *otto.Otto
+	abi  string
+	doc  string
+	data string
+}
+
+// New prepares a NatSpec evaluator for a transaction with the given ABI,
+// NatSpec metadata document and call data (all as returned by the
+// corresponding eth/bzz JSON-RPC calls, i.e. hex-encoded where relevant).
+func New(abi, doc, data string) (*NatSpec, error) {
+	vm := otto.New()
+	if _, err := vm.Run(jsSource); err != nil {
+		return nil, err
+	}
+	return &NatSpec{vm: vm, abi: abi, doc: doc, data: data}, nil
+}
+
+// Notice returns the human-readable description of the transaction, to be
+// shown to the user before they confirm it.
+func (self *NatSpec) Notice() (string, error) {
+	val, err := self.vm.Call("evaluateExpression", nil, self.abi, self.doc, self.data)
+	if err != nil {
+		return "", err
+	}
+	notice := val.String()
+	if notice == "" {
+		return "", fmt.Errorf("no NatSpec notice found for this transaction")
+	}
+	return notice, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestTopicRadiusConverge feeds a topicRadius enough weight just inside a
+// simulated population edge to make sure it converges on the corresponding
+// bucket without needing any real sleeps.
+func TestTopicRadiusConverge(t *testing.T) {
+	sim := new(mclock.Simulated)
+	r := newTopicRadius("test")
+
+	const edge = uint64(1) << 40
+	idx := bucketIdx(edge - 1)
+
+	now := sim.Now()
+	// Weight just inside the edge forms the peak; weight further out (at
+	// bucket 0, the farthest bucket) gives recalc enough rightSum to trust
+	// it's a real population edge rather than noise.
+	for i := 0; i < minPeakSize+3; i++ {
+		r.buckets[idx].decay(now)
+		r.buckets[idx].weight++
+		sim.Run(time.Second)
+		now = sim.Now()
+	}
+	for i := 0; i < minRightSum+3; i++ {
+		r.buckets[0].decay(now)
+		r.buckets[0].weight++
+		sim.Run(time.Second)
+		now = sim.Now()
+	}
+	r.recalc(now)
+
+	if !r.converged {
+		t.Fatalf("topicRadius did not converge, histogram = %v", r.Histogram())
+	}
+	if r.radius != bucketUpperBound(idx) {
+		t.Errorf("radius = %d, want %d (bucket %d)", r.radius, bucketUpperBound(idx), idx)
+	}
+}
+
+// TestTokenBucketDebt checks that a tokenBucket refills over simulated time,
+// caps accumulated debt, and can burst-spend it once available.
+func TestTokenBucketDebt(t *testing.T) {
+	sim := new(mclock.Simulated)
+	b := newTokenBucket(time.Second, 3)
+
+	now := sim.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("expected token %d to be available from the initial debt cap", i)
+		}
+	}
+	if ok, wait := b.take(now); ok {
+		t.Fatalf("bucket should be empty after spending its full cap")
+	} else if wait <= 0 {
+		t.Errorf("wait should be positive once empty, got %v", wait)
+	}
+
+	// Advance well past several refill periods; debt should still cap at 3.
+	sim.Run(10 * time.Second)
+	now = sim.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("expected token %d to be available after accumulating debt", i)
+		}
+	}
+	if ok, _ := b.take(now); ok {
+		t.Fatalf("bucket should be empty again after spending its full debt cap")
+	}
+}
+
+// TestRegisterTopicStops checks that RegisterTopic performs at least one
+// lookup and then returns promptly once stop is closed, cleaning up the
+// topic's ticket state behind it.
+func TestRegisterTopicStops(t *testing.T) {
+	s := newTicketStore(mclock.System{}, nil)
+	stop := make(chan struct{})
+	close(stop)
+
+	lookups := 0
+	lookup := func(target common.Hash) []*Node { lookups++; return nil }
+	ping := func(n *Node) []byte { return nil }
+
+	s.RegisterTopic("test", stop, lookup, ping)
+
+	if lookups == 0 {
+		t.Errorf("expected RegisterTopic to perform at least one lookup before observing stop")
+	}
+	if _, ok := s.tickets["test"]; ok {
+		t.Errorf("expected the topic's ticket state to be removed once RegisterTopic returns")
+	}
+}
+
+// TestSearchTopicStops checks that SearchTopic returns promptly once stop is
+// closed, cleaning up the search state behind it.
+func TestSearchTopicStops(t *testing.T) {
+	s := newTicketStore(mclock.System{}, nil)
+	stop := make(chan struct{})
+	close(stop)
+	found := make(chan *Node, 1)
+
+	lookup := func(target common.Hash) []*Node { return nil }
+	query := func(n *Node, topic Topic) []byte { return nil }
+
+	s.SearchTopic("test", stop, found, lookup, query)
+
+	if _, ok := s.searches["test"]; ok {
+		t.Errorf("expected the search state to be removed once SearchTopic returns")
+	}
+}
+
+// TestIterRegTopicsRoundRobin checks that iterRegTopics cycles through every
+// registered topic once per pass in a fixed order, instead of favouring
+// whichever topic was added last (the LIFO stack this replaced).
+func TestIterRegTopicsRoundRobin(t *testing.T) {
+	s := newTicketStore(mclock.System{}, nil)
+	topics := []Topic{"a", "b", "c"}
+	for _, topic := range topics {
+		s.addTopic(topic, true)
+	}
+
+	// iterRegTopics refills in Keccak256-hash order; compute the same order
+	// here so the test doesn't depend on which topic happened to be added last.
+	want := append([]Topic{}, topics...)
+	sort.Slice(want, func(i, j int) bool {
+		hi, hj := crypto.Keccak256Hash([]byte(want[i])), crypto.Keccak256Hash([]byte(want[j]))
+		return bytes.Compare(hi[:], hj[:]) < 0
+	})
+
+	for round := 0; round < 3; round++ {
+		for _, topic := range want {
+			got, ok := s.iterRegTopics()
+			if !ok {
+				t.Fatalf("round %d: iterRegTopics returned no topic, want %q", round, topic)
+			}
+			if got != topic {
+				t.Errorf("round %d: iterRegTopics = %q, want %q (round-robin order)", round, got, topic)
+			}
+		}
+	}
+}
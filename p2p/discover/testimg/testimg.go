@@ -1,56 +1,121 @@
+// testimg renders the binary topic-discovery trace written by a
+// discover.binaryTracer (see p2p/discover/trace.go for the record format)
+// into one heatmap PNG per topic, replacing the old single-topic text
+// format (*N/*R/*W/*+ markers) this tool used to scan with bufio.ScanWords.
 package main
 
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"image"
 	"image/png"
 	"os"
 	"sort"
-	"strconv"
+)
+
+// Mirrors the record layout documented in p2p/discover/trace.go; kept in
+// sync by hand since the fields are unexported there and this is a
+// standalone tool with no import path back into the discover package.
+const (
+	traceRecordLen = 40
 
-	"github.com/ethereum/go-ethereum/crypto"
+	traceRegister = 1
+	traceLookup   = 2
+	traceWait     = 3
+	traceRadius   = 4
 )
 
+type traceRecord struct {
+	kind        uint64
+	time        int64
+	topicPrefix uint64
+	nodePrefix  uint64
+	value       uint64
+}
+
+func readTrace(path string) []traceRecord {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	n := len(data) / traceRecordLen
+	records := make([]traceRecord, n)
+	for i := 0; i < n; i++ {
+		rec := data[i*traceRecordLen : (i+1)*traceRecordLen]
+		records[i] = traceRecord{
+			kind:        binary.BigEndian.Uint64(rec[0:8]),
+			time:        int64(binary.BigEndian.Uint64(rec[8:16])),
+			topicPrefix: binary.BigEndian.Uint64(rec[16:24]),
+			nodePrefix:  binary.BigEndian.Uint64(rec[24:32]),
+			value:       binary.BigEndian.Uint64(rec[32:40]),
+		}
+	}
+	return records
+}
+
 func main() {
-	var xs, ys, maxTime int
+	records := readTrace("test.trace")
 
-	topicHash := crypto.Keccak256Hash([]byte("foo"))
-	topicPrefix := binary.BigEndian.Uint64(topicHash[:8])
-	var nodes uint64Slice
+	byTopic := make(map[uint64][]traceRecord)
+	for _, r := range records {
+		byTopic[r.topicPrefix] = append(byTopic[r.topicPrefix], r)
+	}
+	for topicPrefix, recs := range byTopic {
+		renderTopic(topicPrefix, recs)
+	}
+}
 
-	f, _ := os.Open("test.out")
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		w := scanner.Text()
-		if w == "*N" {
-			scanner.Scan()
-			prefix, _ := strconv.ParseUint(scanner.Text(), 16, 64)
-			nodes = append(nodes, prefix^topicPrefix)
+// renderTopic draws two images for one topic's trace: a heatmap of
+// registrations (green), wait periods (red) and radius samples (blue)
+// against time (x) and XOR-distance-ranked nodes (y), and a one-pixel-high
+// strip marking the times at which radius samples were recorded. The strip
+// does not encode the radius values; those appear only in the heatmap.
+func renderTopic(topicPrefix uint64, recs []traceRecord) {
+	var minTime, maxTime int64
+	first := true
+	for _, r := range recs {
+		if first || r.time < minTime {
+			minTime = r.time
 		}
-		if w == "*R" {
-			scanner.Scan()
-			time, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			if int(time) > maxTime {
-				maxTime = int(time)
-			}
+		if first || r.time > maxTime {
+			maxTime = r.time
+		}
+		first = false
+	}
+	span := maxTime - minTime
+	if span == 0 {
+		span = 1
+	}
+
+	var nodes uint64Slice
+	seen := make(map[uint64]bool)
+	for _, r := range recs {
+		if r.kind != traceRegister && r.kind != traceWait {
+			continue
+		}
+		dist := r.nodePrefix ^ topicPrefix
+		if !seen[dist] {
+			seen[dist] = true
+			nodes = append(nodes, dist)
 		}
 	}
-	f.Close()
 	sort.Sort(nodes)
-	nodeIdx := make(map[uint64]int)
-	for i, v := range nodes {
-		nodeIdx[v^topicPrefix] = i
+	nodeIdx := make(map[uint64]int, len(nodes))
+	for i, dist := range nodes {
+		nodeIdx[dist] = i
 	}
 
-	xs = maxTime / 10000
-	ys = len(nodes)
+	const xs = 1000
+	ys := len(nodes)
+	if ys == 0 {
+		ys = 1
+	}
 
 	pic := image.NewNRGBA(image.Rect(0, 0, xs, ys))
-	set := func(x, y, c, v int) {
+	set := func(x, y, c int, v uint8) {
 		if x >= 0 && x < xs && y >= 0 && y < ys {
-			pic.Pix[y*pic.Stride+x*4+c] = uint8(v)
+			pic.Pix[y*pic.Stride+x*4+c] = v
 		}
 	}
 	for y := 0; y < ys; y++ {
@@ -59,50 +124,38 @@ func main() {
 		}
 	}
 
-	f, _ = os.Open("test.out")
-	scanner = bufio.NewScanner(f)
-	scanner.Split(bufio.ScanWords)
-
-	for scanner.Scan() {
-		w := scanner.Text()
-		if w == "*R" {
-			scanner.Scan()
-			time, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			scanner.Scan()
-			scanner.Scan()
-			rad, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			radUint := uint64(rad) * ((^uint64(0)) / 1000000)
-			x := int(time * int64(xs) / int64(maxTime))
-			y := sort.Search(ys, func(i int) bool {
-				return nodes[i] > radUint
-			})
+	radiusStrip := image.NewNRGBA(image.Rect(0, 0, xs, 1))
+
+	for _, r := range recs {
+		x := int((r.time - minTime) * xs / span)
+		switch r.kind {
+		case traceRegister:
+			set(x, nodeIdx[r.nodePrefix^topicPrefix], 1, 255)
+		case traceWait:
+			wp := r.value / 1000000 // ns -> ms, clamp below
+			if wp > 255 {
+				wp = 255
+			}
+			set(x, nodeIdx[r.nodePrefix^topicPrefix], 0, uint8(wp))
+		case traceRadius:
+			y := sort.Search(ys, func(i int) bool { return nodes[i] > r.value })
 			set(x, y, 2, 255)
-		}
-		if w == "*W" {
-			scanner.Scan()
-			time, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			scanner.Scan()
-			prefix, _ := strconv.ParseUint(scanner.Text(), 16, 64)
-			scanner.Scan()
-			wp, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			x := int(time * int64(xs) / int64(maxTime))
-			y := nodeIdx[prefix]
-			set(x, y, 0, int(wp/1000))
-		}
-		if w == "*+" {
-			scanner.Scan()
-			time, _ := strconv.ParseInt(scanner.Text(), 10, 64)
-			scanner.Scan()
-			prefix, _ := strconv.ParseUint(scanner.Text(), 16, 64)
-			x := int(time * int64(xs) / int64(maxTime))
-			y := nodeIdx[prefix]
-			set(x, y, 1, 255)
-			scanner.Scan()
+			if x >= 0 && x < xs {
+				radiusStrip.Pix[x*4+2] = 255
+				radiusStrip.Pix[x*4+3] = 255
+			}
 		}
 	}
-	f.Close()
 
-	f, _ = os.Create("test.png")
+	writePNG(fmt.Sprintf("test-%016x.png", topicPrefix), pic)
+	writePNG(fmt.Sprintf("test-%016x-radius.png", topicPrefix), radiusStrip)
+}
+
+func writePNG(name string, pic image.Image) {
+	f, err := os.Create(name)
+	if err != nil {
+		return
+	}
 	w := bufio.NewWriter(f)
 	png.Encode(w, pic)
 	w.Flush()
@@ -19,13 +19,17 @@ package discover
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
 	"time"
 
-	"github.com/aristanetworks/goarista/atime"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 const (
@@ -35,38 +39,27 @@ const (
 	keepTicketExp       = time.Minute * 5
 	maxRadius           = 0xffffffffffffffff
 	minRadAverage       = 100
-	minRadStableAfter   = 50
 	targetWaitTime      = time.Minute * 10
-	adjustRatio         = 0.002
-	adjustCooldownStart = 0.1
-	adjustCooldownStep  = 0.01
-	radiusExtendRatio   = 1.5
 )
 
-// absTime represents absolute monotonic time in nanoseconds.
-type absTime time.Duration
-
-func monotonicTime() absTime {
-	return absTime(atime.NanoTime())
-}
-
 // timeBucket represents absolute monotonic time in minutes.
 // It is used as the index into the per-topic ticket buckets.
 type timeBucket int
 
 type ticket struct {
 	topics  []Topic
-	regTime []absTime // Per-topic local absolute time when the ticket can be used.
+	regTime []mclock.AbsTime // Per-topic local absolute time when the ticket can be used.
 
 	// The serial number that was issued by the server.
 	serial uint32
 	// Used by registrar, tracks absolute time when the ticket was created.
-	issueTime absTime
+	issueTime mclock.AbsTime
 
 	// Fields used only by registrants
 	node   *Node  // the registrar node that signed this ticket
 	refCnt int    // tracks number of topics that will be registered using this ticket
 	pong   []byte // encoded pong packet signed by the registrar
+	mac    []byte // HMAC the registrar bound to (node, serial, issueTime, topics, waitPeriods) at issue time, replayed verbatim in topicRegister; see ticketMAC in topic.go
 }
 
 // ticketRef refers to a single topic in a ticket.
@@ -79,11 +72,11 @@ func (ref ticketRef) topic() Topic {
 	return ref.t.topics[ref.idx]
 }
 
-func (ref ticketRef) topicRegTime() absTime {
+func (ref ticketRef) topicRegTime() mclock.AbsTime {
 	return ref.t.regTime[ref.idx]
 }
 
-func pongToTicket(localTime absTime, topics []Topic, node *Node, p *ingressPacket) (*ticket, error) {
+func pongToTicket(localTime mclock.AbsTime, topics []Topic, node *Node, p *ingressPacket) (*ticket, error) {
 	wps := p.data.(*pong).WaitPeriods
 	if len(topics) != len(wps) {
 		return nil, fmt.Errorf("bad wait period list: got %d values, want %d", len(topics), len(wps))
@@ -96,19 +89,21 @@ func pongToTicket(localTime absTime, topics []Topic, node *Node, p *ingressPacke
 		node:      node,
 		topics:    topics,
 		pong:      p.rawData,
-		regTime:   make([]absTime, len(wps)),
+		mac:       p.data.(*pong).TicketMAC,
+		regTime:   make([]mclock.AbsTime, len(wps)),
 	}
 	// Convert wait periods to local absolute time.
 	for i, wp := range wps {
-		t.regTime[i] = localTime + absTime(time.Second*time.Duration(wp))
+		t.regTime[i] = localTime + mclock.AbsTime(time.Second*time.Duration(wp))
 	}
 	return t, nil
 }
 
 func ticketToPong(t *ticket, pong *pong) {
-	pong.Expiration = uint64(t.issueTime / absTime(time.Second))
+	pong.Expiration = uint64(t.issueTime / mclock.AbsTime(time.Second))
 	pong.TopicHash = rlpHash(t.topics)
 	pong.TicketSerial = t.serial
+	pong.TicketMAC = t.mac
 	pong.WaitPeriods = make([]uint32, len(t.regTime))
 	for i, regTime := range t.regTime {
 		pong.WaitPeriods[i] = uint32(time.Duration(regTime-t.issueTime) / time.Second)
@@ -124,48 +119,172 @@ type ticketStore struct {
 	// that can be used in that minute.
 	// This is only set if the topic is being registered.
 	tickets     map[Topic]topicTickets
-	regtopics   []Topic
 	nodes       map[*Node]*ticket
 	nodeLastReq map[*Node]reqInfo
 
+	// regQueue and regSet implement a round-robin schedule over registered
+	// topics: regQueue holds the current order and is popped from the
+	// front, regSet tracks which of its entries are still live so that a
+	// topic removed mid-queue (removeRegisterTopic) is skipped rather than
+	// iterated. This replaces the earlier LIFO stack, whose bias meant a
+	// topic added last could starve older ones of collection lookups.
+	regQueue []Topic
+	regSet   map[Topic]struct{}
+
+	// collectLimit and registerLimit throttle, per registered topic, how
+	// often a collection lookup is started and how often a ticket is
+	// spent to register, see tokenBucket.
+	collectLimit  map[Topic]*tokenBucket
+	registerLimit map[Topic]*tokenBucket
+
+	// searches holds the state of topics currently being searched for
+	// (searchTopic), keyed the same way tickets is keyed for registration.
+	searches     map[Topic]*topicSearch
+	searchtopics []Topic
+	sentQueries  map[common.Hash]*sentQuery
+
 	lastBucketFetched timeBucket
 	nextTicketCached  *ticketRef
-	nextTicketReg     absTime
+	nextTicketReg     mclock.AbsTime
 
 	minRadCnt, minRadPtr uint64
 	minRadius, minRadSum uint64
 	lastMinRads          [minRadAverage]uint64
 
-	log *logChn
+	// clock is used for all time measurements so that tests can drive the
+	// store with mclock.Simulated instead of real sleeps.
+	clock mclock.Clock
+
+	// db persists each topic's radius histogram (see topicRadius.save) so a
+	// restarted node resumes its peak search instead of starting over at
+	// maxRadius. May be nil, in which case persistence is skipped.
+	db *nodeDB
+
+	// tracer observes radius adjustments; defaults to noopTracer{}.
+	tracer TopicTracer
 }
 
 type topicTickets map[timeBucket][]ticketRef
 
-func newTicketStore() *ticketStore {
+func newTicketStore(clock mclock.Clock, db *nodeDB) *ticketStore {
 	return &ticketStore{
 		radius:      make(map[Topic]*topicRadius),
 		tickets:     make(map[Topic]topicTickets),
 		nodes:       make(map[*Node]*ticket),
 		nodeLastReq: make(map[*Node]reqInfo),
+		searches:    make(map[Topic]*topicSearch),
+		sentQueries: make(map[common.Hash]*sentQuery),
+
+		collectLimit:  make(map[Topic]*tokenBucket),
+		registerLimit: make(map[Topic]*tokenBucket),
+
+		regSet: make(map[Topic]struct{}),
+
+		clock:  clock,
+		db:     db,
+		tracer: noopTracer{},
+	}
+}
+
+// SetTracer installs tracer to observe radius adjustments made by s.
+// Passing nil restores the default no-op tracer.
+func (s *ticketStore) SetTracer(tracer TopicTracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	s.tracer = tracer
+}
+
+const (
+	// collectFrequency and maxCollectDebt bound how often a collection
+	// lookup may be started for one topic: one token is added every
+	// collectFrequency, up to maxCollectDebt may accumulate, so a topic
+	// that has been idle for a while can burst through its backlog once
+	// it becomes active again.
+	collectFrequency = 30 * time.Second
+	maxCollectDebt   = 10
+
+	// registerFrequency and maxRegisterDebt bound how often a ticket may
+	// be spent to register one topic, on the same principle.
+	registerFrequency = 60 * time.Second
+	maxRegisterDebt   = 5
+)
+
+// tokenBucket is a simple token bucket rate limiter: one token is added
+// every period, up to cap tokens may accumulate, and each attempt consumes
+// one token.
+type tokenBucket struct {
+	tokens float64
+	cap    float64
+	period time.Duration
+
+	lastTime mclock.AbsTime
+}
+
+func newTokenBucket(period time.Duration, cap float64) *tokenBucket {
+	return &tokenBucket{tokens: cap, cap: cap, period: period}
+}
+
+// refill adds the tokens accumulated since the last call, capped at b.cap.
+func (b *tokenBucket) refill(now mclock.AbsTime) {
+	if dt := now - b.lastTime; dt > 0 {
+		b.tokens += float64(dt) / float64(b.period)
+		if b.tokens > b.cap {
+			b.tokens = b.cap
+		}
+		b.lastTime = now
+	}
+}
+
+// peek reports whether a token is currently available without consuming
+// it, and if not, how long until one is.
+func (b *tokenBucket) peek(now mclock.AbsTime) (ok bool, wait time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(b.period))
+}
+
+// take consumes one token if available and reports whether it succeeded;
+// if not, wait is the time until a token becomes available.
+func (b *tokenBucket) take(now mclock.AbsTime) (ok bool, wait time.Duration) {
+	ok, wait = b.peek(now)
+	if ok {
+		b.tokens--
 	}
+	return ok, wait
+}
+
+// nextAvailable returns the absolute time at which this bucket will next
+// have a spendable token. Exposing this (rather than just ok/wait) lets a
+// caller order per-topic collectLimit/registerLimit buckets by urgency,
+// which is what a future priority-queue scheduler would need instead of
+// the linear scan nextRegisterableTicket does today.
+func (b *tokenBucket) nextAvailable(now mclock.AbsTime) mclock.AbsTime {
+	_, wait := b.peek(now)
+	return now + mclock.AbsTime(wait)
 }
 
 // addTopic starts tracking a topic. If register is true,
 // the local node will register the topic and tickets will be collected.
 // It can be called even
 func (s *ticketStore) addTopic(t Topic, register bool) {
-	s.log.log(fmt.Sprintf(" addTopic(%v, %v)", t, register))
+	log.Trace("Adding discovery topic", "topic", t, "register", register)
 	if s.radius[t] == nil {
 		s.radius[t] = newTopicRadius(t)
+		s.radius[t].load(s.db, s.clock)
 	}
 	if register && s.tickets[t] == nil {
 		s.tickets[t] = make(topicTickets)
+		s.collectLimit[t] = newTokenBucket(collectFrequency, maxCollectDebt)
+		s.registerLimit[t] = newTokenBucket(registerFrequency, maxRegisterDebt)
 	}
 }
 
 // removeRegisterTopic deletes all tickets for the given topic.
 func (s *ticketStore) removeRegisterTopic(topic Topic) {
-	s.log.log(fmt.Sprintf(" removeRegisterTopic(%v)", topic))
+	log.Trace("Removing discovery topic", "topic", topic)
 	for _, list := range s.tickets[topic] {
 		for _, ref := range list {
 			ref.t.refCnt--
@@ -176,6 +295,9 @@ func (s *ticketStore) removeRegisterTopic(topic Topic) {
 		}
 	}
 	delete(s.tickets, topic)
+	delete(s.collectLimit, topic)
+	delete(s.registerLimit, topic)
+	delete(s.regSet, topic)
 }
 
 func (s *ticketStore) regTopicSet() []Topic {
@@ -187,14 +309,28 @@ func (s *ticketStore) regTopicSet() []Topic {
 }
 
 // nextRegisterLookup returns the target of the next lookup for ticket collection.
+// Topics whose collectLimit bucket has no token left are skipped; if every
+// topic is either satisfied or rate limited, delay is the time until the
+// soonest-refilling bucket can be tried again.
 func (s *ticketStore) nextRegisterLookup() (lookup lookupInfo, delay time.Duration) {
-	s.log.log("nextRegisterLookup()")
+	now := s.clock.Now()
+	minWait := 40 * time.Second
 	firstTopic, ok := s.iterRegTopics()
 	for topic := firstTopic; ok; {
-		s.log.log(fmt.Sprintf(" checking topic %v, len(s.tickets[topic]) = %d", topic, len(s.tickets[topic])))
-		if s.tickets[topic] != nil && s.needMoreTickets(topic) {
+		ready := s.tickets[topic] != nil && s.needMoreTickets(topic)
+		if ready {
+			if limit := s.collectLimit[topic]; limit != nil {
+				if allowed, wait := limit.take(now); !allowed {
+					ready = false
+					if wait < minWait {
+						minWait = wait
+					}
+				}
+			}
+		}
+		if ready {
 			next := s.radius[topic].nextTarget()
-			s.log.log(fmt.Sprintf(" %x 1s", next[:8]))
+			log.Trace("Found discovery lookup topic", "topic", topic, "target", next)
 			return lookupInfo{target: next, topic: topic}, 1 * time.Second
 		}
 		topic, ok = s.iterRegTopics()
@@ -202,49 +338,64 @@ func (s *ticketStore) nextRegisterLookup() (lookup lookupInfo, delay time.Durati
 			break // We have checked all topics.
 		}
 	}
-	s.log.log(" null, 40s")
-	return lookupInfo{}, 40 * time.Second
+	log.Trace("No topic ready for lookup", "wait", minWait)
+	return lookupInfo{}, minWait
 }
 
-// iterRegTopics returns topics to register in arbitrary order.
+// iterRegTopics returns topics to register, in round-robin order: each call
+// pops the topic at the front of regQueue, refilling it from s.tickets (in a
+// deterministic order, sorted by the Keccak256 hash of the topic string) once
+// it runs dry. A topic that was removed via removeRegisterTopic after being
+// queued is no longer in regSet, so it's discarded rather than returned.
 // The second return value is false if there are no topics.
 func (s *ticketStore) iterRegTopics() (Topic, bool) {
-	s.log.log("iterRegTopics()")
-	if len(s.regtopics) == 0 {
-		if len(s.tickets) == 0 {
-			s.log.log(" false")
-			return "", false
+	for {
+		if len(s.regQueue) == 0 {
+			if len(s.tickets) == 0 {
+				return "", false
+			}
+			// Refill the queue in a deterministic order so that iteration
+			// order doesn't depend on Go's randomized map iteration.
+			topics := make([]Topic, 0, len(s.tickets))
+			for t := range s.tickets {
+				topics = append(topics, t)
+				s.regSet[t] = struct{}{}
+			}
+			sort.Slice(topics, func(i, j int) bool {
+				hi, hj := crypto.Keccak256Hash([]byte(topics[i])), crypto.Keccak256Hash([]byte(topics[j]))
+				return bytes.Compare(hi[:], hj[:]) < 0
+			})
+			s.regQueue = topics
 		}
-		// Refill register list.
-		for t := range s.tickets {
-			s.regtopics = append(s.regtopics, t)
+		topic := s.regQueue[0]
+		s.regQueue = s.regQueue[1:]
+		if _, ok := s.regSet[topic]; !ok {
+			continue // Removed while queued, skip it.
 		}
+		delete(s.regSet, topic)
+		return topic, true
 	}
-	topic := s.regtopics[len(s.regtopics)-1]
-	s.regtopics = s.regtopics[:len(s.regtopics)-1]
-	s.log.log(" " + string(topic) + " true")
-	return topic, true
 }
 
 // ticketsInWindow returns the number of tickets in the registration window.
 func (s *ticketStore) needMoreTickets(t Topic) bool {
-	now := monotonicTime()
-	ltBucket := timeBucket(now / absTime(ticketTimeBucketLen))
+	now := s.clock.Now()
+	ltBucket := timeBucket(now / mclock.AbsTime(ticketTimeBucketLen))
 	var sum float64
 	tickets := s.tickets[t]
 	for g := ltBucket; g < ltBucket+timeWindow; g++ {
 		for _, t := range tickets[g] {
 			l := t.t.regTime[t.idx] - t.t.issueTime
-			if l > absTime(ticketTimeBucketLen)*timeWindow {
-				l = absTime(ticketTimeBucketLen) * timeWindow
+			if l > mclock.AbsTime(ticketTimeBucketLen)*timeWindow {
+				l = mclock.AbsTime(ticketTimeBucketLen) * timeWindow
 			}
-			if l < absTime(time.Minute) {
-				l = absTime(time.Minute)
+			if l < mclock.AbsTime(time.Minute) {
+				l = mclock.AbsTime(time.Minute)
 			}
 			sum += float64(targetWaitTime) / float64(l)
 		}
 	}
-	s.log.log(fmt.Sprintf("ticketsInWindow(%v) = %v", t, sum))
+	log.Trace("Computed ticket window sum", "topic", t, "sum", sum)
 	return sum < 10
 }
 
@@ -256,19 +407,23 @@ func (s *ticketStore) needMoreTickets(t Topic) bool {
 //
 // A ticket can be returned more than once with <= zero wait time in case
 // the ticket contains multiple topics.
+//
+// A ticket whose topic's registerLimit bucket has no token left is still
+// returned (so the caller knows it exists), but wait is raised to the time
+// the bucket needs to refill; the bucket itself isn't charged until the
+// ticket is actually used, see ticketRegistered.
 func (s *ticketStore) nextRegisterableTicket() (t *ticketRef, wait time.Duration) {
 	defer func() {
 		if t == nil {
-			s.log.log(" nil")
+			log.Trace("No registerable ticket found")
 		} else {
-			s.log.log(fmt.Sprintf(" node = %x sn = %v wait = %v", t.t.node.ID[:8], t.t.serial, wait))
+			log.Trace("Found registerable ticket", "node", t.t.node.ID, "serial", t.t.serial, "wait", wait)
 		}
 	}()
 
-	s.log.log("nextRegisterableTicket()")
-	now := monotonicTime()
+	now := s.clock.Now()
 	if s.nextTicketCached != nil {
-		return s.nextTicketCached, time.Duration(s.nextTicketCached.topicRegTime() - now)
+		return s.nextTicketCached, s.registerWait(s.nextTicketCached, now)
 	}
 
 	for bucket := s.lastBucketFetched; ; bucket++ {
@@ -281,7 +436,7 @@ func (s *ticketStore) nextRegisterableTicket() (t *ticketRef, wait time.Duration
 				empty = false
 				if list := tickets[bucket]; list != nil {
 					for _, ref := range list {
-						//s.log.log(fmt.Sprintf(" nrt bucket = %d node = %x sn = %v wait = %v", bucket, ref.t.node.ID[:8], ref.t.serial, time.Duration(ref.topicRegTime()-now)))
+						//log.Trace("Checked registerable ticket", "bucket", bucket, "node", ref.t.node.ID, "serial", ref.t.serial, "wait", time.Duration(ref.topicRegTime()-now))
 						if nextTicket.t == nil || ref.topicRegTime() < nextTicket.topicRegTime() {
 							nextTicket = ref
 						}
@@ -293,23 +448,38 @@ func (s *ticketStore) nextRegisterableTicket() (t *ticketRef, wait time.Duration
 			return nil, 0
 		}
 		if nextTicket.t != nil {
-			wait = time.Duration(nextTicket.topicRegTime() - now)
 			s.nextTicketCached = &nextTicket
-			return &nextTicket, wait
+			return &nextTicket, s.registerWait(&nextTicket, now)
 		}
 		s.lastBucketFetched = bucket
 	}
 }
 
+// registerWait returns the wait time nextRegisterableTicket should report
+// for ref: the time until it can be used, or the time until its topic's
+// registerLimit bucket refills, whichever is later.
+func (s *ticketStore) registerWait(ref *ticketRef, now mclock.AbsTime) time.Duration {
+	wait := time.Duration(ref.topicRegTime() - now)
+	if limit := s.registerLimit[ref.topic()]; limit != nil {
+		if allowed, limitWait := limit.peek(now); !allowed && limitWait > wait {
+			wait = limitWait
+		}
+	}
+	return wait
+}
+
 // ticketRegistered is called when t has been used to register for a topic.
 func (s *ticketStore) ticketRegistered(ref ticketRef) {
-	s.log.log(fmt.Sprintf("ticketRegistered(node = %x sn = %v)", ref.t.node.ID[:8], ref.t.serial))
+	log.Debug("Ticket registered", "node", ref.t.node.ID, "serial", ref.t.serial)
 	topic := ref.topic()
+	if limit := s.registerLimit[topic]; limit != nil {
+		limit.take(s.clock.Now())
+	}
 	tickets := s.tickets[topic]
 	if tickets == nil {
 		return
 	}
-	bucket := timeBucket(ref.t.regTime[ref.idx] / absTime(ticketTimeBucketLen))
+	bucket := timeBucket(ref.t.regTime[ref.idx] / mclock.AbsTime(ticketTimeBucketLen))
 	list := tickets[bucket]
 	idx := -1
 	for i, bt := range list {
@@ -358,7 +528,7 @@ func (t *ticket) findIdx(topic Topic) int {
 }
 
 func (s *ticketStore) registerLookupDone(lookup lookupInfo, nodes []*Node, ping func(n *Node) []byte) {
-	now := monotonicTime()
+	now := s.clock.Now()
 	//fmt.Printf("registerLookupDone  target = %016x\n", target[:8])
 	if len(nodes) > 0 {
 		s.adjustMinRadius(lookup.target, nodes[0].sha)
@@ -378,25 +548,29 @@ func (s *ticketStore) registerLookupDone(lookup lookupInfo, nodes []*Node, ping
 	}
 }
 
-func (s *ticketStore) adjustWithTicket(localTime absTime, t *ticket, idx int, onlyConverging bool) {
+func (s *ticketStore) adjustWithTicket(localTime mclock.AbsTime, t *ticket, idx int, onlyConverging bool) {
 	if onlyConverging {
 		for i, topic := range t.topics {
-			if tt, ok := s.radius[topic]; ok && !tt.converged && tt.isInRadius(t, true) {
-				tt.adjust(localTime, ticketRef{t, i}, s.minRadius, s.minRadCnt >= minRadStableAfter)
-				s.log.log(fmt.Sprintf("adjust converging topic: %v, rad: %v, cd: %v, converged: %v", topic, float64(tt.radius)/maxRadius, tt.adjustCooldown, tt.converged))
+			if tt, ok := s.radius[topic]; ok && !tt.converged {
+				tt.adjust(localTime, ticketRef{t, i})
+				tt.save(s.db)
+				s.tracer.OnRadius(topic, tt.radius)
+				log.Trace("Adjusted converging topic radius", "topic", topic, "radius", tt.radius, "converged", tt.converged)
 			}
 		}
 	} else {
 		topic := t.topics[idx]
-		if tt, ok := s.radius[topic]; ok && tt.isInRadius(t, true) {
-			tt.adjust(localTime, ticketRef{t, idx}, s.minRadius, s.minRadCnt >= minRadStableAfter)
-			s.log.log(fmt.Sprintf("adjust topic: %v, rad: %v, cd: %v, converged: %v", topic, float64(tt.radius)/maxRadius, tt.adjustCooldown, tt.converged))
+		if tt, ok := s.radius[topic]; ok {
+			tt.adjust(localTime, ticketRef{t, idx})
+			tt.save(s.db)
+			s.tracer.OnRadius(topic, tt.radius)
+			log.Trace("Adjusted topic radius", "topic", topic, "radius", tt.radius, "converged", tt.converged)
 		}
 	}
 }
 
-func (s *ticketStore) addTicket(localTime absTime, pingHash []byte, t *ticket) {
-	s.log.log(fmt.Sprintf("add(node = %x sn = %v)", t.node.ID[:8], t.serial))
+func (s *ticketStore) addTicket(localTime mclock.AbsTime, pingHash []byte, t *ticket) {
+	log.Trace("Adding discovery ticket", "node", t.node.ID, "serial", t.serial)
 
 	if s.nodes[t.node] != nil {
 		return
@@ -414,13 +588,13 @@ func (s *ticketStore) addTicket(localTime absTime, pingHash []byte, t *ticket) {
 	}
 
 	s.adjustWithTicket(localTime, t, topicIdx, false)
-	bucket := timeBucket(localTime / absTime(ticketTimeBucketLen))
+	bucket := timeBucket(localTime / mclock.AbsTime(ticketTimeBucketLen))
 	if s.lastBucketFetched == 0 || bucket < s.lastBucketFetched {
 		s.lastBucketFetched = bucket
 	}
 
 	for topicIdx, topic := range t.topics {
-		if tt, ok := s.radius[topic]; ok && tt.isInRadius(t, false) && s.needMoreTickets(topic) {
+		if tt, ok := s.radius[topic]; ok && tt.isInRadius(t) && s.needMoreTickets(topic) {
 			if tickets, ok := s.tickets[topic]; ok && tt.converged {
 				wait := t.regTime[topicIdx] - localTime
 				rnd := rand.ExpFloat64()
@@ -429,7 +603,7 @@ func (s *ticketStore) addTicket(localTime absTime, pingHash []byte, t *ticket) {
 				}
 				if float64(wait) < float64(keepTicketConst)+float64(keepTicketExp)*rnd {
 					// use the ticket to register this topic
-					bucket := timeBucket(t.regTime[topicIdx] / absTime(ticketTimeBucketLen))
+					bucket := timeBucket(t.regTime[topicIdx] / mclock.AbsTime(ticketTimeBucketLen))
 					tickets[bucket] = append(tickets[bucket], ticketRef{t, topicIdx})
 					t.refCnt++
 				}
@@ -443,11 +617,223 @@ func (s *ticketStore) addTicket(localTime absTime, pingHash []byte, t *ticket) {
 	}
 }
 
+const (
+	// topicQueryTimeout is how long we wait for a reply to an outstanding
+	// topicQuery before giving up on it.
+	topicQueryTimeout = 5 * time.Second
+	// topicQueryResend is the minimum time between two topicQuery packets
+	// sent to the same node for the same topic, so a slow reply doesn't
+	// get duplicated.
+	topicQueryResend = time.Minute
+	// searchForceQuery is the number of consecutive lookups that returned
+	// no new node before a search falls back to re-querying nodes it
+	// already knows about, instead of waiting on fresh lookup results.
+	searchForceQuery = 8
+)
+
+// topicQuery asks the recipient for nodes it knows to have registered
+// Topic. The reply is a topicNodes packet echoing rlpHash of this packet.
+type topicQuery struct {
+	Topic      Topic
+	Expiration uint64
+}
+
+// topicNodes is the reply to a topicQuery, capped at lookupWidth entries by
+// the sender.
+type topicNodes struct {
+	Echo  common.Hash
+	Nodes []rpcNode
+}
+
+// topicRegister is the wire message a client sends to spend a ticket it
+// collected earlier (see addTicket/pongToTicket) and register under one of
+// its topics: Topics is the ticket's full topic list (so the registrar can
+// recompute and verify Pong's topic hash), Idx selects which of those
+// topics this registration is for, and Pong is the raw PONG packet the
+// ticket was issued in.
+type topicRegister struct {
+	Topics []Topic
+	Idx    uint
+	Pong   []byte
+}
+
+// registerTicket is the server-side counterpart of topicRegister: it spends
+// t (already decoded and signature-checked from msg.Pong by the caller) in
+// table, registering whichever of t's topics are currently within their
+// registration window - not only the one named by idx, since useTicket
+// already filters on wait time, not on which topic triggered the send. idx
+// must name one of t's topics (an out-of-range idx is rejected), but isn't
+// otherwise needed to decide what gets registered.
+func registerTicket(table *TopicTable, t *ticket, idx uint, expiry time.Duration) bool {
+	if int(idx) >= len(t.topics) {
+		return false
+	}
+	waitPeriods := make([]uint32, len(t.topics))
+	for i, regTime := range t.regTime {
+		waitPeriods[i] = uint32(time.Duration(regTime-t.issueTime) / time.Second)
+	}
+	issueTime := uint32(t.issueTime / mclock.AbsTime(time.Second))
+	return table.useTicket(t.node, t.serial, issueTime, t.topics, waitPeriods, t.mac, expiry)
+}
+
+// sentQuery tracks one outstanding topicQuery, keyed by the hash of the
+// packet so the reply can be matched back to the topicSearch it belongs to
+// regardless of which node it came from.
+type sentQuery struct {
+	search *topicSearch
+	node   *Node
+	sent   mclock.AbsTime
+	resent bool
+}
+
+// topicSearch holds the state of one ongoing searchTopic call.
+type topicSearch struct {
+	topic Topic
+	found chan<- *Node
+	seen  map[*Node]bool
+
+	// noNewNodes counts consecutive lookups that produced no unseen node,
+	// see searchForceQuery.
+	noNewNodes int
+}
+
+func newTopicSearch(topic Topic, found chan<- *Node) *topicSearch {
+	return &topicSearch{topic: topic, found: found, seen: make(map[*Node]bool)}
+}
+
+// searchTopic starts searching for nodes that have registered topic t,
+// streaming de-duplicated results to found. The actual lookups and
+// TOPIC_QUERY/TOPIC_NODES packet exchange are driven by the caller through
+// nextSearchLookup/searchLookupDone/gotTopicNodes, mirroring the
+// nextRegisterLookup/registerLookupDone pair on the registration side.
+// Calling searchTopic again for a topic that is already being searched
+// just replaces found; the accumulated radius and seen-node state carry
+// over.
+func (s *ticketStore) searchTopic(t Topic, found chan<- *Node) {
+	log.Trace("Starting topic search", "topic", t)
+	s.addTopic(t, false)
+	if search, ok := s.searches[t]; ok {
+		search.found = found
+		return
+	}
+	s.searches[t] = newTopicSearch(t, found)
+}
+
+// stopSearchingTopic cancels an ongoing search started with searchTopic.
+func (s *ticketStore) stopSearchingTopic(t Topic) {
+	delete(s.searches, t)
+}
+
+// iterSearchTopics returns topics being searched for in arbitrary order,
+// refilling from s.searches once exhausted. The second return value is
+// false if there are no topics being searched.
+func (s *ticketStore) iterSearchTopics() (Topic, bool) {
+	if len(s.searchtopics) == 0 {
+		if len(s.searches) == 0 {
+			return "", false
+		}
+		for t := range s.searches {
+			s.searchtopics = append(s.searchtopics, t)
+		}
+	}
+	topic := s.searchtopics[len(s.searchtopics)-1]
+	s.searchtopics = s.searchtopics[:len(s.searchtopics)-1]
+	return topic, true
+}
+
+// nextSearchLookup returns the target of the next lookup used to discover
+// candidate nodes for a searched topic.
+func (s *ticketStore) nextSearchLookup() (lookup lookupInfo, delay time.Duration) {
+	topic, ok := s.iterSearchTopics()
+	if !ok {
+		return lookupInfo{}, 40 * time.Second
+	}
+	return lookupInfo{target: s.radius[topic].nextTarget(), topic: topic}, 1 * time.Second
+}
+
+// searchLookupDone processes the result of a lookup started through
+// nextSearchLookup. Every candidate within the topic's current radius that
+// hasn't been queried yet is sent a topicQuery via query, which should
+// return the hash of the packet it sent (or nil if sending failed). If
+// searchForceQuery consecutive lookups produce no unseen candidate, nodes
+// already known to be in radius are re-queried instead of waiting for more
+// lookup results to arrive.
+func (s *ticketStore) searchLookupDone(lookup lookupInfo, nodes []*Node, query func(n *Node, topic Topic) []byte) {
+	search, ok := s.searches[lookup.topic]
+	if !ok {
+		return
+	}
+	radius := s.radius[lookup.topic]
+	now := s.clock.Now()
+
+	send := func(n *Node) {
+		for _, sq := range s.sentQueries {
+			if sq.search == search && sq.node == n && now-sq.sent < mclock.AbsTime(topicQueryResend) {
+				return
+			}
+		}
+		if hash := query(n, lookup.topic); hash != nil {
+			s.sentQueries[common.BytesToHash(hash)] = &sentQuery{search: search, node: n, sent: now}
+		}
+	}
+
+	newNodes := 0
+	for _, n := range nodes {
+		if search.seen[n] || (radius != nil && !radius.withinRadius(n)) {
+			continue
+		}
+		search.seen[n] = true
+		newNodes++
+		send(n)
+	}
+
+	if newNodes > 0 {
+		search.noNewNodes = 0
+		return
+	}
+	search.noNewNodes++
+	if search.noNewNodes >= searchForceQuery {
+		for n := range search.seen {
+			send(n)
+		}
+	}
+}
+
+// gotTopicNodes processes a topicNodes reply received from a previously
+// sent topicQuery, streaming any newly discovered node to the search's
+// found channel. It reports whether resp.Echo matched a pending query; a
+// reply arriving more than topicQueryTimeout after its query is discarded.
+func (s *ticketStore) gotTopicNodes(from *Node, resp *topicNodes) bool {
+	sq, ok := s.sentQueries[resp.Echo]
+	if !ok || sq.node != from {
+		return false
+	}
+	delete(s.sentQueries, resp.Echo)
+	if s.clock.Now()-sq.sent > mclock.AbsTime(topicQueryTimeout) {
+		return false
+	}
+
+	search := sq.search
+	for _, rn := range resp.Nodes {
+		n, err := nodeFromRPC(from, rn)
+		if err != nil || search.seen[n] {
+			continue
+		}
+		search.seen[n] = true
+		search.noNewNodes = 0
+		select {
+		case search.found <- n:
+		default:
+		}
+	}
+	return true
+}
+
 func (s *ticketStore) getNodeTicket(node *Node) *ticket {
 	if s.nodes[node] == nil {
-		s.log.log(fmt.Sprintf("getNodeTicket(%x) sn = nil", node.ID[:8]))
+		log.Trace("Retrieved node ticket", "node", node.ID, "serial", nil)
 	} else {
-		s.log.log(fmt.Sprintf("getNodeTicket(%x) sn = %v", node.ID[:8], s.nodes[node].serial))
+		log.Trace("Retrieved node ticket", "node", node.ID, "serial", s.nodes[node].serial)
 	}
 	return s.nodes[node]
 }
@@ -479,16 +865,53 @@ func (s *ticketStore) adjustMinRadius(target, found common.Hash) {
 	} else {
 		s.minRadius = s.minRadSum
 	}
-	s.log.log(fmt.Sprintf("adjustMinRadius() %v", float64(s.minRadius)/maxRadius))
+	log.Trace("Adjusted minimum radius", "radius", s.minRadius)
+}
+
+const (
+	// radiusBucketsPerBit subdivides each power-of-two octave of XOR
+	// distance into this many buckets, giving the peak detector enough
+	// resolution to find a slope within a single bit of distance.
+	radiusBucketsPerBit = 8
+	radiusBuckets       = radiusBucketsPerBit * 64
+
+	// radiusTC is the exponential decay time constant applied to bucket
+	// weights, so that a topic's population shifting over time is
+	// reflected within roughly this long.
+	radiusTC = time.Minute * 20
+
+	minPeakSize = 15 // minimum cumulative weight (from the closest bucket) to call something a peak
+	minSlope    = 1  // minimum bucket-over-bucket weight increase to call it a peak
+	minRightSum = 20 // minimum cumulative weight still further out than the peak
+	maxNoAdjust = 2  // consecutive non-adjusting samples tolerated before declaring convergence anyway
+	lookupWidth = 8  // spread (as a multiplicative factor) of nextTarget samples around the radius
+)
+
+// topicRadiusBucket accumulates a decaying weight of tickets/nodes observed
+// at the XOR distance range the bucket covers (see topicRadius.bucketIdx).
+type topicRadiusBucket struct {
+	weight   float64
+	lastTime mclock.AbsTime
+}
+
+func (b *topicRadiusBucket) decay(now mclock.AbsTime) {
+	if b.lastTime == 0 {
+		b.lastTime = now
+		return
+	}
+	if dt := float64(now - b.lastTime); dt > 0 {
+		b.weight *= math.Exp(-dt / float64(radiusTC))
+	}
+	b.lastTime = now
 }
 
 type topicRadius struct {
 	topic           Topic
 	topicHashPrefix uint64
 	radius          uint64
-	adjustCooldown  float64 // only for convergence detection
+	buckets         [radiusBuckets]topicRadiusBucket
 	converged       bool
-	intExtBalance   float64
+	noAdjustCount   int
 }
 
 func newTopicRadius(t Topic) *topicRadius {
@@ -499,17 +922,74 @@ func newTopicRadius(t Topic) *topicRadius {
 		topic:           t,
 		topicHashPrefix: topicHashPrefix,
 		radius:          maxRadius,
-		adjustCooldown:  adjustCooldownStart,
-		converged:       false,
 	}
 }
 
-func (r *topicRadius) isInRadius(t *ticket, extRadius bool) bool {
-	nodePrefix := binary.BigEndian.Uint64(t.node.sha[0:8])
-	dist := nodePrefix ^ r.topicHashPrefix
-	if extRadius {
-		return float64(dist) < float64(r.radius)*radiusExtendRatio
+// bucketIdx maps an XOR distance to the bucket that covers it. Bucket i
+// covers distances in [2^(64-i/radiusBucketsPerBit-1), 2^(64-i/radiusBucketsPerBit)),
+// so index 0 is the farthest (least dense) bucket and radiusBuckets-1 is
+// the closest (covering the smallest distances, right around our own ID).
+func bucketIdx(dist uint64) int {
+	bit := bitLen64(dist) - 1 // dist in [2^bit, 2^(bit+1)), or bit == -1 if dist == 0
+	if bit < 0 {
+		return radiusBuckets - 1
 	}
+	span := uint64(1) << uint(bit)
+	frac := dist - span
+	sub := int(frac * radiusBucketsPerBit / span)
+	idx := (63-bit)*radiusBucketsPerBit + sub
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= radiusBuckets {
+		idx = radiusBuckets - 1
+	}
+	return idx
+}
+
+// bucketUpperBound returns the upper (exclusive) distance edge of bucket i,
+// i.e. the radius a lookup must not exceed to stay inside it. Within an
+// octave, the sub-bucket (i % radiusBucketsPerBit) shifts the bound by a
+// fraction of the octave's span, giving the 8x finer resolution the
+// radiusBucketsPerBit doc comment promises instead of collapsing every
+// sub-bucket in an octave to the same power-of-two edge.
+func bucketUpperBound(i int) uint64 {
+	octave := i / radiusBucketsPerBit
+	sub := i % radiusBucketsPerBit
+	bit := 63 - octave
+	switch {
+	case bit < 0:
+		return 1
+	case bit >= 63 && sub == radiusBucketsPerBit-1:
+		return maxRadius
+	default:
+		span := uint64(1) << uint(bit)
+		return span + (span/radiusBucketsPerBit)*uint64(sub+1)
+	}
+}
+
+// bitLen64 returns the position (1-64) of the highest set bit in x, or 0 if
+// x == 0. Kept local (instead of math/bits) to match this package's
+// baseline toolchain.
+func bitLen64(x uint64) int {
+	n := 0
+	for x != 0 {
+		n++
+		x >>= 1
+	}
+	return n
+}
+
+func (r *topicRadius) isInRadius(t *ticket) bool {
+	return r.withinRadius(t.node)
+}
+
+// withinRadius reports whether n's distance from the topic hash is within
+// the current radius estimate. It is used both by the registration side
+// (via isInRadius) and by topic search, which only has a *Node to test.
+func (r *topicRadius) withinRadius(n *Node) bool {
+	nodePrefix := binary.BigEndian.Uint64(n.sha[0:8])
+	dist := nodePrefix ^ r.topicHashPrefix
 	return dist < r.radius
 }
 
@@ -520,104 +1000,136 @@ func randUint64n(n uint64) uint64 { // don't care about lowest bit, 63 bit rando
 	return uint64(rand.Int63n(int64(n/2))) * 2
 }
 
+// nextTarget samples a lookup target whose distance from the topic hash is
+// spread around the current radius estimate by a factor of lookupWidth, so
+// that lookups keep refining the histogram around the region that matters
+// without being pinned to a single point.
 func (r *topicRadius) nextTarget() common.Hash {
-	var rnd uint64
-	if r.intExtBalance < 0 {
-		// select target from inner region
-		rnd = randUint64n(r.radius)
+	var dist uint64
+	if r.radius == maxRadius {
+		dist = randUint64n(maxRadius)
 	} else {
-		// select target from outer region
-		e := float64(r.radius) * radiusExtendRatio
-		extRadius := uint64(maxRadius)
-		if e < maxRadius {
-			extRadius = uint64(e)
+		lo := r.radius / lookupWidth
+		hi := uint64(maxRadius)
+		if r.radius <= maxRadius/lookupWidth { // overflow guard
+			hi = r.radius * lookupWidth
 		}
-		rnd = r.radius + randUint64n(extRadius-r.radius)
+		dist = lo + randUint64n(hi-lo)
 	}
-	prefix := r.topicHashPrefix ^ rnd
+	prefix := r.topicHashPrefix ^ dist
 	var target common.Hash
 	binary.BigEndian.PutUint64(target[0:8], prefix)
 	return target
 }
 
-func (r *topicRadius) adjust(localTime absTime, t ticketRef, minRadius uint64, minRadStable bool) {
-	var balanceStep, stepSign float64
-	if r.isInRadius(t.t, false) {
-		balanceStep = radiusExtendRatio - 1
-		stepSign = 1
-	} else {
-		balanceStep = -1
-		stepSign = -1
-	}
+// adjust records a ticket observation (the distance of the registering
+// node from the topic hash) into the histogram and re-evaluates the radius.
+func (r *topicRadius) adjust(localTime mclock.AbsTime, t ticketRef) {
+	nodePrefix := binary.BigEndian.Uint64(t.t.node.sha[0:8])
+	dist := nodePrefix ^ r.topicHashPrefix
+	idx := bucketIdx(dist)
+	r.buckets[idx].decay(localTime)
+	r.buckets[idx].weight++
+	r.recalc(localTime)
+}
 
-	if r.intExtBalance*stepSign > 3 {
-		return
+// recalc scans the histogram from the closest bucket outward, looking for
+// a "peak": a point with enough accumulated weight so far, a big enough
+// jump at that bucket, and enough weight still further out to trust it's a
+// real population edge rather than noise. If no such peak is found for
+// maxNoAdjust consecutive calls, the topic is declared converged at its
+// last radius anyway (e.g. a topic too sparse to ever show a clean peak).
+func (r *topicRadius) recalc(now mclock.AbsTime) {
+	var rightSum float64
+	for i := range r.buckets {
+		r.buckets[i].decay(now)
+		rightSum += r.buckets[i].weight
 	}
-	r.intExtBalance += balanceStep
 
-	wait := t.t.regTime[t.idx] - t.t.issueTime // localTime
-	/*	adjust := (float64(wait)/float64(targetWaitTime) - 1) * 2
-		if adjust > 1 {
-			adjust = 1
+	var cum, prev float64
+	peakIdx := -1
+	for i := radiusBuckets - 1; i >= 0; i-- {
+		w := r.buckets[i].weight
+		rightSum -= w
+		cum += w
+		if cum >= minPeakSize && w-prev >= minSlope && rightSum >= minRightSum {
+			peakIdx = i
+			break
 		}
-		if adjust < -1 {
-			adjust = -1
-		}*/
-	var adjust float64
-	if wait > absTime(targetWaitTime) {
-		adjust = 1
-	} else {
-		adjust = -1
+		prev = w
 	}
 
-	if r.converged {
-		adjust *= adjustRatio
-	} else {
-		adjust *= r.adjustCooldown
+	if peakIdx >= 0 {
+		r.radius = bucketUpperBound(peakIdx)
+		r.converged = true
+		r.noAdjustCount = 0
+		return
 	}
 
-	/*if adjust > 0 {
-		adjust *= radiusExtendRatio*2 - 1
-	}*/
-
-	radius := float64(r.radius) * (1 + adjust)
-	if radius > float64(maxRadius) {
-		r.radius = maxRadius
-	} else {
-		r.radius = uint64(radius)
-		if r.radius < minRadius {
-			r.radius = minRadius
-		}
+	r.noAdjustCount++
+	if r.noAdjustCount >= maxNoAdjust {
+		r.converged = true
 	}
+}
 
-	if !r.converged && (adjust > 0 || (r.radius == minRadius && minRadStable)) {
-		r.adjustCooldown *= (1 - adjustCooldownStep)
-		if r.adjustCooldown <= adjustRatio {
-			r.converged = true
-		}
+// Histogram returns a copy of the current per-bucket weights, exposed for
+// tests and diagnostic logging.
+func (r *topicRadius) Histogram() []float64 {
+	w := make([]float64, radiusBuckets)
+	for i, b := range r.buckets {
+		w[i] = b.weight
 	}
-
+	return w
 }
 
-type logChn struct {
-	list []string
+// persistedRadius is topicRadius's on-disk representation: just enough to
+// resume the peak search where it left off, so a restarted node doesn't
+// have to reconverge on a topic's radius from maxRadius again.
+type persistedRadius struct {
+	Radius    uint64
+	Converged bool
+	Buckets   [radiusBuckets]float64
 }
 
-func (c *logChn) log(s string) {
-	if c != nil {
-		fmt.Println(time.Now().String() + " : " + s)
-		//c.list = append(c.list, time.Now().String()+" : "+s)
+// save writes r's histogram to db under r.topic, if db is non-nil.
+func (r *topicRadius) save(db *nodeDB) {
+	if db == nil {
+		return
+	}
+	pr := persistedRadius{Radius: r.radius, Converged: r.converged}
+	for i := range r.buckets {
+		pr.Buckets[i] = r.buckets[i].weight
 	}
+	data, err := json.Marshal(pr)
+	if err != nil {
+		log.Warn("Failed to encode persisted topic radius", "topic", r.topic, "err", err)
+		return
+	}
+	db.storeTopicRadius(r.topic, data)
 }
 
-func (c *logChn) printLogs() {
-	if c != nil {
-		for _, s := range c.list {
-			fmt.Println(s)
-		}
+// load restores r's histogram from db, if db is non-nil and has a prior
+// entry for r.topic. Bucket weights are re-anchored to clock's current time
+// so the first decay() call afterwards doesn't treat the whole gap since the
+// last save as elapsed time.
+func (r *topicRadius) load(db *nodeDB, clock mclock.Clock) {
+	if db == nil {
+		return
+	}
+	data := db.fetchTopicRadius(r.topic)
+	if data == nil {
+		return
+	}
+	var pr persistedRadius
+	if err := json.Unmarshal(data, &pr); err != nil {
+		log.Warn("Failed to decode persisted topic radius", "topic", r.topic, "err", err)
+		return
+	}
+	r.radius = pr.Radius
+	r.converged = pr.Converged
+	now := clock.Now()
+	for i, w := range pr.Buckets {
+		r.buckets[i] = topicRadiusBucket{weight: w, lastTime: now}
 	}
 }
 
-func newlogChn() *logChn {
-	return &logChn{}
-}
\ No newline at end of file
@@ -24,16 +24,43 @@ package discover
 
 import (
 	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"math"
-	"math/rand"
+	mrand "math/rand"
 	"time"
 
 	"github.com/aristanetworks/goarista/atime"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
+// gaugeGlobalEntries tracks TopicTable.globalEntries, the total number of
+// advertised entries across all topics, regardless of which ones are active.
+var gaugeGlobalEntries = metrics.GetOrRegisterGauge("discover/topic/global/entries")
+
+// timerNoTicketUntil records the distribution of noTicketTimeout() durations
+// handed out in useTicket, i.e. how long nodes get throttled after a
+// successful registration.
+var timerNoTicketUntil = metrics.GetOrRegisterTimer("discover/topic/noTicketUntil")
+
 const MaxEntries = 10000
 const MaxEntriesPerTopic = 50
 
+// MaxEntriesPerNode caps how many entries a single node may hold across all
+// of its topics combined, independent of how many topics it registers
+// under - without it, a node could multiply its effective share of the
+// table just by spreading the same registration across more topics.
+const MaxEntriesPerNode = 100
+
+// minTopicQuota is the floor topicQuota will return, so a topic that has
+// backed off to a very long waitPeriod still keeps a handful of slots
+// rather than being evictable down to zero.
+const minTopicQuota = 4
+
 type Topic string
 
 type topicEntry struct {
@@ -66,6 +93,22 @@ type nodeInfo struct {
 	lastIssuedTicket, lastUsedTicket uint32
 }
 
+// persistedTopicEntry is one row of the topic-scoped keyspace write-through
+// persistence adds to nodeDB: a single AddEntries registration, enough to
+// rebuild a topicEntry (modulo re-resolving the node's endpoint, which the
+// table doesn't own) after a restart.
+//
+// storeTopicEntry/deleteTopicEntry/fetchTopicEntries exercise this round trip
+// through *nodeDB, but nodeDB itself lives in udp.go in the real tree, which
+// isn't present in this snapshot - there's nothing here to construct a
+// *nodeDB against, so the round trip can't be covered by a test in this
+// package until that file is restored.
+type persistedTopicEntry struct {
+	topic  Topic
+	node   NodeID
+	expire uint64 // nanotime, same clock as topicEntry.expire
+}
+
 type TopicTable struct {
 	db                    *nodeDB
 	nodes                 map[*Node]*nodeInfo
@@ -74,13 +117,115 @@ type TopicTable struct {
 	requested             topicRequestQueue
 	requestCnt            uint64
 	lastGarbageCollection uint64 // nanotime
+	tracer                TopicTracer
+
+	// ticketSecret/prevTicketSecret authenticate the tickets this table
+	// hands out in getTicket, so useTicket can tell a replayed or forged
+	// (serialNo, topics, waitPeriods) tuple from one it actually issued,
+	// rather than trusting whatever the caller presents. The secret rotates
+	// every ticketSecretRotation; the previous one stays valid for one more
+	// rotation so tickets issued just before a rotation aren't rejected.
+	ticketSecret, prevTicketSecret [32]byte
+	ticketSecretExpire             uint64 // nanotime
 }
 
 func NewTopicTable(db *nodeDB) *TopicTable {
-	return &TopicTable{
+	t := &TopicTable{
 		db:     db,
 		nodes:  make(map[*Node]*nodeInfo),
 		topics: make(map[Topic]*topicInfo),
+		tracer: noopTracer{},
+	}
+	t.rotateTicketSecret()
+	t.loadPersisted()
+	return t
+}
+
+// ticketSecretRotation bounds how long a single HMAC key used to sign
+// tickets stays in use.
+const ticketSecretRotation = 24 * time.Hour
+
+// rotateTicketSecret generates a fresh ticketSecret once ticketSecretExpire
+// has passed, demoting the current secret to prevTicketSecret so tickets
+// issued just before the rotation still verify.
+func (t *TopicTable) rotateTicketSecret() {
+	tm := atime.NanoTime()
+	if tm < t.ticketSecretExpire {
+		return
+	}
+	t.prevTicketSecret = t.ticketSecret
+	if _, err := rand.Read(t.ticketSecret[:]); err != nil {
+		log.Error("Failed to generate topic ticket secret", "err", err)
+	}
+	t.ticketSecretExpire = tm + uint64(ticketSecretRotation)
+}
+
+// ticketMAC binds serialNo, issueTime, topics and waitPeriods to node under
+// key, so a node can't register with a tuple this table didn't actually
+// issue in getTicket.
+func ticketMAC(key [32]byte, node NodeID, serialNo, issueTime uint32, topics []Topic, waitPeriods []uint32) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(node[:])
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], serialNo)
+	h.Write(buf[:])
+	binary.BigEndian.PutUint32(buf[:], issueTime)
+	h.Write(buf[:])
+	for _, topic := range topics {
+		binary.BigEndian.PutUint32(buf[:], uint32(len(topic)))
+		h.Write(buf[:])
+		h.Write([]byte(topic))
+	}
+	for _, w := range waitPeriods {
+		binary.BigEndian.PutUint32(buf[:], w)
+		h.Write(buf[:])
+	}
+	return h.Sum(nil)
+}
+
+// SetTracer installs tracer to observe registrations, lookups and wait
+// periods handed out by t. Passing nil restores the default no-op tracer.
+func (t *TopicTable) SetTracer(tracer TopicTracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	t.tracer = tracer
+}
+
+func topicEntriesGauge(topic Topic) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(fmt.Sprintf("discover/topic/%s/entries", topic))
+}
+
+func topicWaitPeriodGauge(topic Topic) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(fmt.Sprintf("discover/topic/%s/waitPeriod", topic))
+}
+
+// loadPersisted seeds the table with topic entries a previous instance
+// wrote through AddEntries, skipping anything whose expire has already
+// passed. Without this, a restarted node advertises nothing until its
+// entries reappear through live registrations, even though its peers may
+// still be holding valid, unexpired ones.
+func (t *TopicTable) loadPersisted() {
+	if t.db == nil {
+		return
+	}
+	now := atime.NanoTime()
+	for _, pe := range t.db.fetchTopicEntries() {
+		if pe.expire <= now {
+			continue
+		}
+		node := &Node{ID: pe.node}
+		n := t.getOrNewNode(node)
+		if _, ok := n.entries[pe.topic]; ok {
+			continue
+		}
+		te := t.getOrNewTopic(pe.topic)
+		fifoIdx := te.fifoHead
+		te.fifoHead++
+		entry := &topicEntry{topic: pe.topic, fifoIdx: fifoIdx, node: node, expire: pe.expire}
+		te.entries[fifoIdx] = entry
+		n.entries[pe.topic] = entry
+		t.globalEntries++
 	}
 }
 
@@ -154,26 +299,76 @@ func (t *TopicTable) GetEntries(topic Topic) []*Node {
 	}
 	t.requestCnt++
 	t.requested.update(te.rqItem, t.requestCnt)
+	t.tracer.OnLookup(topic)
 	return nodes
 }
 
+// topicQuota returns the soft cap on ti's entry count, proportional to its
+// waitPeriod: a hot topic (short waitPeriod, lots of incoming registration
+// traffic) earns more slots than a quiet one, instead of every topic
+// competing for the same fixed MaxEntriesPerTopic share. It never exceeds
+// MaxEntriesPerTopic nor drops below minTopicQuota.
+func topicQuota(ti *topicInfo) int {
+	wp := ti.wcl.waitPeriod
+	if wp == 0 {
+		wp = minWaitPeriod
+	}
+	q := int(uint64(MaxEntriesPerTopic) * minWaitPeriod / wp)
+	if q > MaxEntriesPerTopic {
+		q = MaxEntriesPerTopic
+	}
+	if q < minTopicQuota {
+		q = minTopicQuota
+	}
+	return q
+}
+
 func (t *TopicTable) AddEntries(node *Node, topics []Topic, expiry time.Duration) {
 	n := t.getOrNewNode(node)
-	// clear previous entries by the same node
-	for _, e := range n.entries {
-		t.deleteEntry(e)
+
+	// Drop entries for topics no longer in the list; topics the node keeps
+	// get their expire refreshed in place below instead of being deleted
+	// and re-inserted, so repeated registration under the same topic
+	// doesn't lose its place in that topic's fifo.
+	wanted := make(map[Topic]bool, len(topics))
+	for _, topic := range topics {
+		wanted[topic] = true
+	}
+	for topic, e := range n.entries {
+		if !wanted[topic] {
+			t.deleteEntry(e)
+		}
 	}
 
 	tm := atime.NanoTime()
 	for _, topic := range topics {
+		if e, ok := n.entries[topic]; ok {
+			e.expire = tm + uint64(expiry)
+			te := t.topics[topic]
+			te.wcl.registered(tm)
+			if t.db != nil {
+				t.db.storeTopicEntry(topic, node.ID, e.expire)
+			}
+			t.tracer.OnRegister(topic, node.ID)
+			continue
+		}
+
 		te := t.getOrNewTopic(topic)
 
-		if len(te.entries) == MaxEntriesPerTopic {
+		limit := MaxEntriesPerTopic
+		if q := topicQuota(te); q < limit {
+			limit = q
+		}
+		if len(te.entries) >= limit {
 			t.deleteEntry(te.getFifoTail())
 		}
 
 		if t.globalEntries == MaxEntries {
-			t.deleteEntry(t.leastRequested()) // not empty, no need to check for nil
+			if e := t.mostOverQuotaEntry(); e != nil {
+				t.deleteEntry(e)
+			} else {
+				t.deleteEntry(t.leastRequested()) // not empty, no need to check for nil
+			}
 		}
 
 		fifoIdx := te.fifoHead
@@ -188,6 +383,32 @@ func (t *TopicTable) AddEntries(node *Node, topics []Topic, expiry time.Duration
 		n.entries[topic] = entry
 		t.globalEntries++
 		te.wcl.registered(tm)
+		if t.db != nil {
+			t.db.storeTopicEntry(topic, node.ID, entry.expire)
+		}
+		t.tracer.OnRegister(topic, node.ID)
+		gaugeGlobalEntries.Update(int64(t.globalEntries))
+		topicEntriesGauge(topic).Update(int64(len(te.entries)))
+	}
+
+	t.enforceNodeCap(n)
+}
+
+// enforceNodeCap evicts n's own entries, most-over-quota topic first, until
+// n holds no more than MaxEntriesPerNode - registering under many topics at
+// once shouldn't buy a node a bigger total share than registering under one.
+func (t *TopicTable) enforceNodeCap(n *nodeInfo) {
+	for len(n.entries) > MaxEntriesPerNode {
+		var worst *topicEntry
+		var worstRatio float64
+		for topic, e := range n.entries {
+			ti := t.topics[topic]
+			ratio := float64(len(ti.entries)) / float64(topicQuota(ti))
+			if worst == nil || ratio > worstRatio {
+				worst, worstRatio = e, ratio
+			}
+		}
+		t.deleteEntry(worst)
 	}
 }
 
@@ -202,6 +423,27 @@ func (t *TopicTable) leastRequested() *topicEntry {
 	return t.topics[t.requested[0].topic].getFifoTail()
 }
 
+// mostOverQuotaEntry returns the fifo tail of whichever topic is furthest
+// past its topicQuota, or nil if no topic is currently over quota.
+func (t *TopicTable) mostOverQuotaEntry() *topicEntry {
+	var worst *topicInfo
+	var worstRatio float64
+	for _, ti := range t.topics {
+		q := topicQuota(ti)
+		if len(ti.entries) <= q {
+			continue
+		}
+		ratio := float64(len(ti.entries)) / float64(q)
+		if worst == nil || ratio > worstRatio {
+			worst, worstRatio = ti, ratio
+		}
+	}
+	if worst == nil {
+		return nil
+	}
+	return worst.getFifoTail()
+}
+
 // entry should exist
 func (t *TopicTable) deleteEntry(e *topicEntry) {
 	ne := t.nodes[e.node].entries
@@ -216,11 +458,32 @@ func (t *TopicTable) deleteEntry(e *topicEntry) {
 		heap.Remove(&t.requested, te.rqItem.index)
 	}
 	t.globalEntries--
+	if t.db != nil {
+		t.db.deleteTopicEntry(e.topic, e.node.ID)
+	}
+	gaugeGlobalEntries.Update(int64(t.globalEntries))
+	topicEntriesGauge(e.topic).Update(int64(len(te.entries)))
 }
 
-// It is assumed that topics and waitPeriods have the same length.
-func (t *TopicTable) useTicket(node *Node, serialNo uint32, topics []Topic, waitPeriods []uint32, expiry time.Duration) (registered bool) {
+// It is assumed that topics and waitPeriods have the same length. mac must
+// match what getTicket computed for (node.ID, serialNo, issueTime, topics,
+// waitPeriods) when it issued serialNo, otherwise the ticket is rejected
+// before any state is touched - this stops a node from registering under a
+// (serialNo, topics, waitPeriods) tuple this table never actually handed out.
+func (t *TopicTable) useTicket(node *Node, serialNo, issueTime uint32, topics []Topic, waitPeriods []uint32, mac []byte, expiry time.Duration) (registered bool) {
 	t.collectGarbage()
+	t.rotateTicketSecret()
+
+	want := ticketMAC(t.ticketSecret, node.ID, serialNo, issueTime, topics, waitPeriods)
+	if !hmac.Equal(mac, want) {
+		if t.prevTicketSecret == ([32]byte{}) {
+			return false // no previous secret yet; an all-zero key would accept anyone's MAC
+		}
+		want = ticketMAC(t.prevTicketSecret, node.ID, serialNo, issueTime, topics, waitPeriods)
+		if !hmac.Equal(mac, want) {
+			return false
+		}
+	}
 
 	n := t.getOrNewNode(node)
 	if serialNo < n.lastUsedTicket {
@@ -243,15 +506,18 @@ func (t *TopicTable) useTicket(node *Node, serialNo uint32, topics []Topic, wait
 	}
 	if regTopics != nil {
 		t.AddEntries(node, regTopics, expiry)
-		n.noTicketUntil = tm + noTicketTimeout()
+		timeout := noTicketTimeout()
+		n.noTicketUntil = tm + timeout
+		timerNoTicketUntil.Update(time.Duration(timeout))
 		return true
 	} else {
 		return false
 	}
 }
 
-func (t *TopicTable) getTicket(node *Node, topics []Topic) (serialNo, currTime uint32, waitUntil []uint32) {
+func (t *TopicTable) getTicket(node *Node, topics []Topic) (serialNo, currTime uint32, waitUntil []uint32, mac []byte) {
 	t.collectGarbage()
+	t.rotateTicketSecret()
 
 	tm := atime.NanoTime()
 	currTime = uint32(tm / 1000000000)
@@ -271,7 +537,10 @@ func (t *TopicTable) getTicket(node *Node, topics []Topic) (serialNo, currTime u
 			w = minWaitPeriod
 		}
 		waitUntil[i] = currTime + uint32(w/1000000000)
+		t.tracer.OnWait(topic, node.ID, time.Duration(w))
+		topicWaitPeriodGauge(topic).Update(int64(w))
 	}
+	mac = ticketMAC(t.ticketSecret, node.ID, serialNo, currTime, topics, waitUntil)
 	return
 }
 
@@ -333,7 +602,7 @@ func (w *waitControlLoop) hasMinimumWaitPeriod() bool {
 }
 
 func noTicketTimeout() uint64 {
-	e := rand.ExpFloat64()
+	e := mrand.ExpFloat64()
 	if e > 100 {
 		e = 100
 	}
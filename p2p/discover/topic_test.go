@@ -0,0 +1,105 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRegisterTicketRejectsBadIdx checks that registerTicket refuses a wire
+// Idx that doesn't name one of the ticket's topics, instead of indexing
+// t.regTime out of range.
+func TestRegisterTicketRejectsBadIdx(t *testing.T) {
+	tk := &ticket{topics: []Topic{"a", "b"}}
+	if registerTicket(nil, tk, 2, time.Minute) {
+		t.Errorf("registerTicket succeeded with an out-of-range idx")
+	}
+}
+
+// TestTicketMACRejectsTamperedTuple checks that ticketMAC - the HMAC useTicket
+// verifies a presented ticket against - changes if any part of the
+// (node, serialNo, issueTime, topics, waitPeriods) tuple it binds is altered
+// after the fact, so a forged tuple with a stolen but otherwise-valid serial
+// can't pass useTicket's hmac.Equal check.
+func TestTicketMACRejectsTamperedTuple(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "test ticket secret")
+	node := NodeID{1}
+	topics := []Topic{"foo", "bar"}
+	waitPeriods := []uint32{10, 20}
+
+	mac := ticketMAC(key, node, 7, 1000, topics, waitPeriods)
+
+	tamperedWait := []uint32{10, 21}
+	if hmac.Equal(mac, ticketMAC(key, node, 7, 1000, topics, tamperedWait)) {
+		t.Errorf("MAC unchanged after tampering with waitPeriods")
+	}
+
+	tamperedTopics := []Topic{"foo", "baz"}
+	if hmac.Equal(mac, ticketMAC(key, node, 7, 1000, tamperedTopics, waitPeriods)) {
+		t.Errorf("MAC unchanged after tampering with topics")
+	}
+
+	// Splitting the same bytes differently across the topic list must not
+	// collide (this is the split-boundary forgery ticketMAC's length-prefix
+	// framing guards against).
+	split := []Topic{"fo", "obar"}
+	if hmac.Equal(mac, ticketMAC(key, node, 7, 1000, split, waitPeriods)) {
+		t.Errorf("MAC collided across a differently split but byte-identical topic list")
+	}
+
+	if !hmac.Equal(mac, ticketMAC(key, node, 7, 1000, topics, waitPeriods)) {
+		t.Errorf("MAC not reproducible for an untampered tuple")
+	}
+}
+
+// TestEnforceNodeCapAcrossTopics checks that a node can't hold more than
+// MaxEntriesPerNode entries by spreading its registrations across many
+// topics - enforceNodeCap must evict down to the cap regardless of how many
+// distinct topics the entries are scattered over.
+func TestEnforceNodeCapAcrossTopics(t *testing.T) {
+	tt := &TopicTable{
+		nodes:  make(map[*Node]*nodeInfo),
+		topics: make(map[Topic]*topicInfo),
+	}
+	node := &Node{ID: NodeID{1}}
+	n := &nodeInfo{entries: make(map[Topic]*topicEntry)}
+	tt.nodes[node] = n
+
+	const numTopics = MaxEntriesPerNode + 20
+	for i := 0; i < numTopics; i++ {
+		topic := Topic(fmt.Sprintf("topic%d", i))
+		ti := tt.getOrNewTopic(topic)
+
+		e := &topicEntry{topic: topic, fifoIdx: 0, node: node}
+		ti.entries[0] = e
+		n.entries[topic] = e
+	}
+
+	if len(n.entries) <= MaxEntriesPerNode {
+		t.Fatalf("test setup bug: need more than MaxEntriesPerNode entries to exercise the cap")
+	}
+
+	tt.enforceNodeCap(n)
+
+	if len(n.entries) > MaxEntriesPerNode {
+		t.Errorf("node holds %d entries after enforceNodeCap, want <= %d (MaxEntriesPerNode)", len(n.entries), MaxEntriesPerNode)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// RegisterTopic advertises the local node under topic until stop is closed.
+// lookup must perform one Kademlia lookup towards target and return the
+// nodes found; ping must send a ping to n (used to request a fresh ticket
+// from it) and return the hash of the packet sent. It drives the same
+// nextRegisterLookup / registerLookupDone / nextRegisterableTicket /
+// ticketRegistered sequence a UDP transport's main loop would, so a future
+// transport only has to supply lookup and ping.
+//
+// Like every other ticketStore method, RegisterTopic is not safe to call
+// concurrently with other methods on s - it must run on the single
+// goroutine that owns the store, the same one that would otherwise be
+// driving nextRegisterLookup by hand.
+func (s *ticketStore) RegisterTopic(topic Topic, stop <-chan struct{}, lookup func(target common.Hash) []*Node, ping func(n *Node) []byte) {
+	log.Trace("Registering discovery topic", "topic", topic)
+	s.addTopic(topic, true)
+	defer s.removeRegisterTopic(topic)
+
+	for {
+		if ref, wait := s.nextRegisterableTicket(); ref != nil && wait <= 0 {
+			s.ticketRegistered(*ref)
+		}
+
+		info, delay := s.nextRegisterLookup()
+		if (info.target != common.Hash{}) {
+			s.registerLookupDone(info, lookup(info.target), ping)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.clock.After(delay):
+		}
+	}
+}
+
+// SearchTopic searches for nodes that have registered topic, streaming
+// de-duplicated results to found until stop is closed. lookup must perform
+// one Kademlia lookup towards target and return the nodes found; query must
+// send a topicQuery to n and return the hash of the packet sent, or nil if
+// sending failed. Replies received for a query started this way are fed
+// back in through gotTopicNodes.
+//
+// Like RegisterTopic, SearchTopic must run on the single goroutine that
+// owns s.
+func (s *ticketStore) SearchTopic(topic Topic, stop <-chan struct{}, found chan<- *Node, lookup func(target common.Hash) []*Node, query func(n *Node, topic Topic) []byte) {
+	log.Trace("Searching discovery topic", "topic", topic)
+	s.searchTopic(topic, found)
+	defer s.stopSearchingTopic(topic)
+
+	for {
+		info, delay := s.nextSearchLookup()
+		if (info.target != common.Hash{}) {
+			s.searchLookupDone(info, lookup(info.target), query)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.clock.After(delay):
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// TopicTracer receives topic-discovery events as they happen. TopicTable and
+// ticketStore each hold one (defaulting to noopTracer{}); replace it with
+// SetTracer to observe what they're doing, e.g. with the binary-log tracer
+// below, which testimg renders into images.
+type TopicTracer interface {
+	// OnRegister is called whenever node is added to, or refreshes its entry
+	// in, topic's advertised entries (TopicTable.AddEntries).
+	OnRegister(topic Topic, node NodeID)
+	// OnLookup is called whenever topic's entries are served to a query
+	// (TopicTable.GetEntries).
+	OnLookup(topic Topic)
+	// OnWait is called whenever a wait period for topic is handed to node,
+	// e.g. in a getTicket reply.
+	OnWait(topic Topic, node NodeID, waitPeriod time.Duration)
+	// OnRadius is called after every topicRadius.adjust with topic's current
+	// radius estimate, whether or not that adjustment changed it.
+	OnRadius(topic Topic, radius uint64)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) OnRegister(Topic, NodeID)           {}
+func (noopTracer) OnLookup(Topic)                     {}
+func (noopTracer) OnWait(Topic, NodeID, time.Duration) {}
+func (noopTracer) OnRadius(Topic, uint64)             {}
+
+// traceRecordLen is the fixed width, in bytes, of every record a
+// binaryTracer writes - no text, no whitespace splitting, so a reader can
+// index straight into the file instead of scanning for delimiters. Layout
+// (all integers big-endian):
+//
+//	offset  size  field
+//	0       8     kind (traceKind, left-padded into a uint64 for alignment)
+//	8       8     time, UnixNano
+//	16      8     topic hash prefix: first 8 bytes of keccak256(topic)
+//	24      8     node hash prefix: first 8 bytes of the node ID (0 if n/a)
+//	32      8     value: wait period in ns, or radius, depending on kind
+const traceRecordLen = 40
+
+type traceKind uint64
+
+const (
+	traceRegister traceKind = 1
+	traceLookup   traceKind = 2
+	traceWait     traceKind = 3
+	traceRadius   traceKind = 4
+)
+
+// binaryTracer appends fixed-width trace records to a file. It's safe for
+// concurrent use from multiple goroutines.
+type binaryTracer struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// newBinaryTracer creates (truncating any existing file) path for
+// append-only trace output.
+func newBinaryTracer(path string) (*binaryTracer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryTracer{f: f}, nil
+}
+
+// Close closes the underlying file.
+func (bt *binaryTracer) Close() error {
+	return bt.f.Close()
+}
+
+func topicHashPrefix(topic Topic) uint64 {
+	h := crypto.Keccak256Hash([]byte(topic))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func nodeHashPrefix(node NodeID) uint64 {
+	return binary.BigEndian.Uint64(node[:8])
+}
+
+func (bt *binaryTracer) write(kind traceKind, topic Topic, node uint64, value uint64) {
+	var rec [traceRecordLen]byte
+	binary.BigEndian.PutUint64(rec[0:8], uint64(kind))
+	binary.BigEndian.PutUint64(rec[8:16], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(rec[16:24], topicHashPrefix(topic))
+	binary.BigEndian.PutUint64(rec[24:32], node)
+	binary.BigEndian.PutUint64(rec[32:40], value)
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if _, err := bt.f.Write(rec[:]); err != nil {
+		log.Warn("Failed to write topic trace record", "err", err)
+	}
+}
+
+func (bt *binaryTracer) OnRegister(topic Topic, node NodeID) {
+	bt.write(traceRegister, topic, nodeHashPrefix(node), 0)
+}
+
+func (bt *binaryTracer) OnLookup(topic Topic) {
+	bt.write(traceLookup, topic, 0, 0)
+}
+
+func (bt *binaryTracer) OnWait(topic Topic, node NodeID, waitPeriod time.Duration) {
+	bt.write(traceWait, topic, nodeHashPrefix(node), uint64(waitPeriod))
+}
+
+func (bt *binaryTracer) OnRadius(topic Topic, radius uint64) {
+	bt.write(traceRadius, topic, 0, radius)
+}
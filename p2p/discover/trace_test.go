@@ -0,0 +1,90 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package discover
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBinaryTracerRecordFormat checks that binaryTracer writes fixed-width,
+// directly-indexable records (no text, no delimiters to scan for) and that
+// each event kind lands the fields testimg needs to decode it back out.
+func TestBinaryTracerRecordFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topictrace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.bin")
+
+	bt, err := newBinaryTracer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.OnRegister("a", NodeID{1})
+	bt.OnLookup("a")
+	bt.OnWait("a", NodeID{1}, 5*time.Second)
+	bt.OnRadius("a", 42)
+	if err := bt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%traceRecordLen != 0 {
+		t.Fatalf("file length %d is not a multiple of traceRecordLen %d", len(data), traceRecordLen)
+	}
+	if got, want := len(data)/traceRecordLen, 4; got != want {
+		t.Fatalf("got %d records, want %d", got, want)
+	}
+
+	rec := func(i int) []byte { return data[i*traceRecordLen : (i+1)*traceRecordLen] }
+	wantTopic := topicHashPrefix("a")
+
+	tests := []struct {
+		kind  traceKind
+		node  uint64
+		value uint64
+	}{
+		{traceRegister, nodeHashPrefix(NodeID{1}), 0},
+		{traceLookup, 0, 0},
+		{traceWait, nodeHashPrefix(NodeID{1}), uint64(5 * time.Second)},
+		{traceRadius, 0, 42},
+	}
+	for i, test := range tests {
+		r := rec(i)
+		if kind := traceKind(binary.BigEndian.Uint64(r[0:8])); kind != test.kind {
+			t.Errorf("record %d: kind = %d, want %d", i, kind, test.kind)
+		}
+		if topic := binary.BigEndian.Uint64(r[16:24]); topic != wantTopic {
+			t.Errorf("record %d: topic hash prefix = %x, want %x", i, topic, wantTopic)
+		}
+		if node := binary.BigEndian.Uint64(r[24:32]); node != test.node {
+			t.Errorf("record %d: node hash prefix = %x, want %x", i, node, test.node)
+		}
+		if value := binary.BigEndian.Uint64(r[32:40]); value != test.value {
+			t.Errorf("record %d: value = %d, want %d", i, value, test.value)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package api defines a registry of named JSON-RPC modules (eth, admin,
+// miner, debug, personal, net, web3, ...). Only the IPC transport
+// (rpc.StartIPC) dispatches through it; the HTTP server and the in-process
+// js console keep their own method tables and do not read the registry.
+package api
+
+import "sort"
+
+// Method is a single JSON-RPC method exposed by a Module, e.g. "call" under
+// the "eth" namespace (wire name "eth_call"). Call receives the decoded
+// params array from the request and returns the result to be marshalled
+// back, or an error whose message the IPC transport returns as the reply's
+// "error" string.
+type Method struct {
+	Name string
+	Call func(params []interface{}) (interface{}, error)
+}
+
+// Module is a named collection of JSON-RPC methods. A Module registered with
+// Register becomes reachable over IPC; it is not exposed over HTTP or the js
+// console by registering.
+type Module interface {
+	Namespace() string
+	Methods() []Method
+}
+
+var registry = make(map[string]Module)
+
+// Register adds m under its namespace, replacing any module previously
+// registered for that namespace. It can be called from package init()
+// functions, so the registry is complete before the IPC endpoint starts.
+func Register(m Module) {
+	registry[m.Namespace()] = m
+}
+
+// Lookup returns the method registered as namespace_name (e.g. "eth",
+// "call" for the wire method "eth_call"), and whether it was found.
+func Lookup(namespace, name string) (Method, bool) {
+	m, ok := registry[namespace]
+	if !ok {
+		return Method{}, false
+	}
+	for _, method := range m.Methods() {
+		if method.Name == name {
+			return method, true
+		}
+	}
+	return Method{}, false
+}
+
+// Namespaces returns every registered module namespace in sorted order.
+func Namespaces() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/rpc/api"
+)
+
+// ipcRequest and ipcResponse are the same framing the HTTP JSON-RPC server
+// speaks: a "namespace_method" wire name with a positional params array,
+// and a result/error reply keyed by the request's Id.
+type ipcRequest struct {
+	Id     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type ipcResponse struct {
+	Id     interface{} `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+var (
+	ipcMu       sync.Mutex
+	ipcListener net.Listener
+)
+
+// StartIPC opens path as a unix domain socket (on Windows it returns an
+// error instead; no named pipe is opened, see ipc_windows.go) and serves
+// JSON-RPC requests over it by looking methods up in the rpc/api registry,
+// until StopIPC is called. The HTTP transport and the js console do not
+// dispatch through that registry; only this transport does. CORS and the
+// HTTP auth middleware do not apply to this transport - a local socket is
+// considered a trusted peer. No module currently calls api.Register, so the
+// registry is empty and every request fails with "the method ... does not
+// exist/is not available" until something does.
+func StartIPC(path string) error {
+	ipcMu.Lock()
+	defer ipcMu.Unlock()
+
+	if ipcListener != nil {
+		return fmt.Errorf("IPC endpoint already open at %s", ipcListener.Addr())
+	}
+
+	l, err := listenIPC(path)
+	if err != nil {
+		return err
+	}
+	ipcListener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveIPCConn(conn)
+		}
+	}()
+
+	glog.V(glog.Info).Infof("IPC endpoint opened: %s\n", path)
+	return nil
+}
+
+// StopIPC closes the IPC listener started by StartIPC, if any.
+func StopIPC() error {
+	ipcMu.Lock()
+	defer ipcMu.Unlock()
+
+	if ipcListener == nil {
+		return nil
+	}
+	err := ipcListener.Close()
+	ipcListener = nil
+	return err
+}
+
+func serveIPCConn(conn net.Conn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req ipcRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		enc.Encode(dispatchIPC(req))
+	}
+}
+
+// dispatchIPC splits req.Method on the last "_" into a namespace and a
+// method name (e.g. "eth_call" -> "eth", "call") and looks it up in the
+// rpc/api registry. The in-process js console does not use this lookup -
+// see the api.Register caveat on StartIPC.
+func dispatchIPC(req ipcRequest) ipcResponse {
+	namespace, name, ok := splitMethod(req.Method)
+	if !ok {
+		return ipcResponse{Id: req.Id, Error: fmt.Sprintf("malformed method %q", req.Method)}
+	}
+	method, ok := api.Lookup(namespace, name)
+	if !ok {
+		return ipcResponse{Id: req.Id, Error: fmt.Sprintf("the method %s does not exist/is not available", req.Method)}
+	}
+	result, err := method.Call(req.Params)
+	if err != nil {
+		return ipcResponse{Id: req.Id, Error: err.Error()}
+	}
+	return ipcResponse{Id: req.Id, Result: result}
+}
+
+func splitMethod(wire string) (namespace, name string, ok bool) {
+	for i := len(wire) - 1; i >= 0; i-- {
+		if wire[i] == '_' {
+			return wire[:i], wire[i+1:], true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,22 @@
+// +build !windows
+
+package rpc
+
+import (
+	"net"
+	"os"
+)
+
+// listenIPC opens a unix domain socket at path, removing any stale socket
+// file left behind by a previous, uncleanly terminated instance.
+func listenIPC(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	return l, nil
+}
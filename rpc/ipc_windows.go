@@ -0,0 +1,15 @@
+// +build windows
+
+package rpc
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenIPC would open path as a named pipe on Windows, but this snapshot
+// doesn't vendor a named-pipe listener package, so it fails clearly instead
+// of silently falling back to a socket that doesn't exist on this platform.
+func listenIPC(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("IPC transport not available on windows in this build: %s", path)
+}